@@ -0,0 +1,198 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+var (
+	// ErrNotAcked returned when a write has been done by this peer,
+	// but it is not acknowledged by enough peers
+	ErrNotAcked = errors.New("write is not acknowledged by enough peers")
+
+	errAckLegacyEncoding = errors.New("write acknowledgement is not supported by the legacy encoding")
+)
+
+// WriteOptions defines the options of SetWithOptions and DeleteWithOptions
+type WriteOptions struct {
+	// Acks is number of the other peers which must acknowledge
+	// that they have merged the write before the write returns.
+	// The write is sent directly to all of the reachable peers,
+	// in addition to the usual gossip.
+	// Leave it to 0 to not wait for the acknowledgement.
+	Acks int
+
+	// AckTimeout bounds the time waiting for the acknowledgements,
+	// in addition to the context.
+	// Leave it to 0 to only use the context.
+	AckTimeout time.Duration
+}
+
+// WriteResult is the result of SetWithOptions and DeleteWithOptions
+type WriteResult struct {
+	// Written is true if the write has been done by this peer.
+	// It is false if DeleteWithOptions is called for a key which not exists,
+	// in which case nothing is sent to the other peers.
+	Written bool
+
+	// AckedBy is the PeerID of the peers which have acknowledged the write
+	AckedBy []uint64
+}
+
+// SetWithOptions is like SetCtx, but it returns the result of the write,
+// and could wait for the write to be acknowledged by the other peers.
+//
+// It returns ErrNotAcked if the write has been done by this peer,
+// but not enough peers acknowledged it before the timeout.
+func (b *Bcache) SetWithOptions(ctx context.Context, key, val string, ttl int, opts WriteOptions) (WriteResult, error) {
+	if ttl <= 0 {
+		return b.DeleteWithOptions(ctx, key, opts)
+	}
+
+	expired := time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	e, _, err := b.peer.setIf(ctx, key, []byte(val), expired, nil)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return b.waitAcks(ctx, key, e, opts)
+}
+
+// DeleteWithOptions is like DeleteCtx, but it returns the result of the write,
+// and could wait for the deletion to be acknowledged by the other peers.
+//
+// It returns ErrNotAcked if the key has been deleted by this peer,
+// but not enough peers acknowledged it before the timeout.
+func (b *Bcache) DeleteWithOptions(ctx context.Context, key string, opts WriteOptions) (WriteResult, error) {
+	deleteTs := time.Now().Add(b.deletionDelay).UnixNano()
+	e, exist, err := b.peer.deleteKey(ctx, key, deleteTs)
+	if err != nil || !exist {
+		return WriteResult{}, err
+	}
+	return b.waitAcks(ctx, key, e, opts)
+}
+
+func (b *Bcache) waitAcks(ctx context.Context, key string, e entry, opts WriteOptions) (WriteResult, error) {
+	res := WriteResult{Written: true}
+	if opts.Acks <= 0 {
+		return res, nil
+	}
+
+	if opts.AckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.AckTimeout)
+		defer cancel()
+	}
+
+	var err error
+	res.AckedBy, err = b.peer.waitAcks(ctx, key, e, reachablePeers(b.router), opts.Acks)
+	return res, err
+}
+
+// ackWaiters dispatches the received acknowledgements to the waiting writes
+type ackWaiters struct {
+	mux     sync.Mutex
+	lastID  uint64
+	waiters map[uint64]chan mesh.PeerName
+}
+
+func newAckWaiters() *ackWaiters {
+	return &ackWaiters{
+		waiters: make(map[uint64]chan mesh.PeerName),
+	}
+}
+
+// add registers new waiter of the acknowledgements from the given number of peers
+func (a *ackWaiters) add(numPeers int) (uint64, <-chan mesh.PeerName) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.lastID++
+	ch := make(chan mesh.PeerName, numPeers)
+	a.waiters[a.lastID] = ch
+	return a.lastID, ch
+}
+
+func (a *ackWaiters) remove(id uint64) {
+	a.mux.Lock()
+	delete(a.waiters, id)
+	a.mux.Unlock()
+}
+
+// done delivers the acknowledgements of the given IDs received from the given peer,
+// the acknowledgements of the unknown IDs are ignored.
+func (a *ackWaiters) done(src mesh.PeerName, ids []uint64) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for _, id := range ids {
+		ch, ok := a.waiters[id]
+		if !ok {
+			continue
+		}
+		select {
+		case ch <- src:
+		default: // duplicate
+		}
+	}
+}
+
+// waitAcks sends the written entry to the given peers, and waits until
+// the given number of them acknowledge that they have merged it.
+// It returns the peers which have acknowledged.
+func (p *peer) waitAcks(ctx context.Context, key string, e entry, peers []mesh.PeerName, numAcks int) ([]uint64, error) {
+	if p.cc.wireOpts.legacyJSON {
+		return nil, errAckLegacyEncoding
+	}
+	if p.send == nil || len(peers) < numAcks {
+		return nil, fmt.Errorf("%w: %d peers are reachable", ErrNotAcked, len(peers))
+	}
+
+	id, ackCh := p.acks.add(len(peers))
+	defer p.acks.remove(id)
+
+	m := p.cc.newMessage(1)
+	m.add(key, e)
+	m.AckID = id
+	bufs := m.Encode()
+
+	for _, dst := range peers {
+		go func(dst mesh.PeerName) {
+			if err := p.unicastBufs(dst, bufs); err != nil {
+				p.logger.Errorf("[%d]unicast to %v failed: %v", p.name, dst, err)
+			}
+		}(dst)
+	}
+
+	var (
+		acked = make([]uint64, 0, numAcks)
+		seen  = make(map[mesh.PeerName]struct{}, numAcks)
+	)
+	for len(acked) < numAcks {
+		select {
+		case src := <-ackCh:
+			if _, ok := seen[src]; ok {
+				continue
+			}
+			seen[src] = struct{}{}
+			acked = append(acked, uint64(src))
+		case <-ctx.Done():
+			return acked, fmt.Errorf("%w: acknowledged by %d peers: %v", ErrNotAcked, len(acked), ctx.Err())
+		}
+	}
+	return acked, nil
+}
+
+// ack sends back the acknowledgement of the received message which requests it
+func (p *peer) ack(src mesh.PeerName, msg *message) {
+	if msg.AckID == 0 {
+		return
+	}
+	m := p.cc.newMessage(0)
+	m.Acks = []uint64{msg.AckID}
+	go p.unicast(src, m)
+}
@@ -0,0 +1,158 @@
+package bcache
+
+// arcStore is store using the Adaptive Replacement Cache (ARC) eviction policy.
+//
+// Like 2Q, it keeps the keys which are used once and the keys which are used
+// more than once in separate lists. It also remembers the keys recently evicted
+// from both lists, and uses the hits on them to adapt the target size
+// of the lists to the workload.
+//
+// It follows the implementation of hashicorp/golang-lru ARC cache,
+// with the evict callback which is not available in that package.
+type arcStore struct {
+	size int
+	p    int // target size of t1
+
+	t1 *list      // keys used once
+	b1 *ghostList // keys evicted from t1
+	t2 *list      // keys used more than once
+	b2 *ghostList // keys evicted from t2
+
+	onEvict evictFunc
+}
+
+func newARCStore(size int, onEvict evictFunc) *arcStore {
+	return &arcStore{
+		size:    size,
+		t1:      newList(),
+		b1:      newGhostList(size),
+		t2:      newList(),
+		b2:      newGhostList(size),
+		onEvict: onEvict,
+	}
+}
+
+func (s *arcStore) Add(key string, val value) {
+	// existing key, update it.
+	// It is not an access, the key is only moved to t2 by Get
+	if s.t1.Contains(key) {
+		s.t1.Add(key, val)
+		return
+	}
+	if s.t2.Contains(key) {
+		s.t2.Add(key, val)
+		return
+	}
+
+	// recently evicted from t1, the target size of t1 is too small
+	if s.b1.Contains(key) {
+		delta := 1
+		if b1Len, b2Len := s.b1.Len(), s.b2.Len(); b2Len > b1Len {
+			delta = b2Len / b1Len
+		}
+		if s.p += delta; s.p > s.size {
+			s.p = s.size
+		}
+
+		if s.t1.Len()+s.t2.Len() >= s.size {
+			s.replace(false)
+		}
+		s.b1.Remove(key)
+		s.t2.Add(key, val)
+		return
+	}
+
+	// recently evicted from t2, the target size of t1 is too big
+	if s.b2.Contains(key) {
+		delta := 1
+		if b1Len, b2Len := s.b1.Len(), s.b2.Len(); b1Len > b2Len {
+			delta = b1Len / b2Len
+		}
+		if s.p -= delta; s.p < 0 {
+			s.p = 0
+		}
+
+		if s.t1.Len()+s.t2.Len() >= s.size {
+			s.replace(true)
+		}
+		s.b2.Remove(key)
+		s.t2.Add(key, val)
+		return
+	}
+
+	// new key
+	if s.t1.Len()+s.t2.Len() >= s.size {
+		s.replace(false)
+	}
+	if s.b1.Len() > s.size-s.p {
+		s.b1.RemoveOldest()
+	}
+	if s.b2.Len() > s.p {
+		s.b2.RemoveOldest()
+	}
+	s.t1.Add(key, val)
+}
+
+// replace evicts a key to make room for the new one
+func (s *arcStore) replace(fromB2 bool) {
+	if key, val, ok := s.evict(fromB2); ok {
+		s.onEvict(key, val)
+	}
+}
+
+// evict removes a key from t1 if it exceeds its target size,
+// otherwise from t2, and remembers it in the ghost list.
+func (s *arcStore) evict(fromB2 bool) (string, value, bool) {
+	t1Len := s.t1.Len()
+	if t1Len > 0 && (t1Len > s.p || (t1Len == s.p && fromB2) || s.t2.Len() == 0) {
+		key, val, ok := s.t1.RemoveOldest()
+		s.b1.Add(key)
+		return key, val, ok
+	}
+
+	key, val, ok := s.t2.RemoveOldest()
+	if ok {
+		s.b2.Add(key)
+	}
+	return key, val, ok
+}
+
+func (s *arcStore) Get(key string) (value, bool) {
+	// used more than once, move it to t2
+	if val, ok := s.t1.Remove(key); ok {
+		s.t2.Add(key, val)
+		return val, true
+	}
+	return s.t2.Get(key)
+}
+
+func (s *arcStore) Peek(key string) (value, bool) {
+	if val, ok := s.t1.Peek(key); ok {
+		return val, true
+	}
+	return s.t2.Peek(key)
+}
+
+func (s *arcStore) Remove(key string) (value, bool) {
+	if val, ok := s.t1.Remove(key); ok {
+		return val, true
+	}
+	if val, ok := s.t2.Remove(key); ok {
+		return val, true
+	}
+	s.b1.Remove(key)
+	s.b2.Remove(key)
+	return value{}, false
+}
+
+func (s *arcStore) RemoveOldest() (string, value, bool) {
+	return s.evict(false)
+}
+
+func (s *arcStore) Keys() []string {
+	return append(s.t1.Keys(), s.t2.Keys()...)
+}
+
+func (s *arcStore) Len() int {
+	return s.t1.Len() + s.t2.Len()
+}
@@ -1,9 +1,11 @@
 package bcache
 
 import (
+	"context"
 	"errors"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/weaveworks/mesh"
@@ -13,21 +15,33 @@ import (
 const (
 	// weaveworks/mesh channel name
 	channel = "bcache"
+
+	// default max duration of the handoff done by Close
+	defaultCloseTimeout = 5 * time.Second
 )
 
 var (
 	// ErrNilFiller returned when GetWithFiller called with nil
 	// filler func
 	ErrNilFiller = errors.New("nil filler")
+
+	// ErrClosed returned when the cache is used after it is closed
+	ErrClosed = errors.New("bcache is closed")
 )
 
 // Bcache represents bcache struct
 type Bcache struct {
 	peer          *peer
 	router        *mesh.Router
+	janitor       *janitor
+	membership    *membership
+	discovery     *discovery
 	logger        Logger
+	metrics       Metrics
 	flight        singleflight.Group
+	fillerStats   fillerStats
 	deletionDelay time.Duration
+	closed        int32
 }
 
 // New creates new bcache from the given config
@@ -56,21 +70,26 @@ func New(cfg Config) (*Bcache, error) {
 		return nil, err
 	}
 
+	password, err := cfg.password()
+	if err != nil {
+		return nil, err
+	}
+
 	// creates mesh router
 	router, err := mesh.NewRouter(mesh.Config{
 		Host:               host,
 		Port:               port,
 		ProtocolMinVersion: mesh.ProtocolMinVersion,
+		Password:           password,
 		ConnLimit:          connLimit,
 		PeerDiscovery:      true,
-		TrustedSubnets:     []*net.IPNet{},
 	}, peerName, nickName, mesh.NullOverlay{}, logger)
 	if err != nil {
 		return nil, err
 	}
 
 	// bcache peer
-	peer, err := newPeer(peerName, cfg.MaxKeys, logger)
+	peer, err := newPeer(peerName, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -83,6 +102,17 @@ func New(cfg Config) (*Bcache, error) {
 
 	peer.register(gossip)
 
+	// start janitor
+	janitor := newJanitor(peer.cc, time.Duration(cfg.JanitorInterval)*time.Second, cfg.JanitorMaxKeys, logger)
+	janitor.start()
+
+	// watch the topology changes
+	membership := newMembership(func() []mesh.PeerName {
+		return reachablePeers(router)
+	}, cfg.OnPeerJoin, cfg.OnPeerLeave)
+	router.Routes.OnChange(membership.changed)
+	membership.start()
+
 	// start mesh router
 	logger.Printf("mesh router starting at %s", cfg.ListenAddr)
 	router.Start()
@@ -90,10 +120,21 @@ func New(cfg Config) (*Bcache, error) {
 	// creates new connection to the provided peers
 	router.ConnectionMaker.InitiateConnections(cfg.Peers, true)
 
+	var discovery *discovery
+	if cfg.PeerProvider != nil {
+		discovery = newDiscovery(cfg.PeerProvider, router.ConnectionMaker,
+			time.Duration(cfg.PeerProviderInterval)*time.Second, logger)
+		discovery.start()
+	}
+
 	return &Bcache{
 		peer:          peer,
 		router:        router,
+		janitor:       janitor,
+		membership:    membership,
+		discovery:     discovery,
 		logger:        logger,
+		metrics:       cfg.Metrics,
 		deletionDelay: time.Duration(cfg.DeletionDelay) * time.Second,
 	}, nil
 }
@@ -101,36 +142,255 @@ func New(cfg Config) (*Bcache, error) {
 // Set sets value for the given key with the given ttl in second.
 // if ttl <= 0, the key will expired instantly
 func (b *Bcache) Set(key, val string, ttl int) {
+	b.SetBytes(key, []byte(val), ttl)
+}
+
+// SetCtx is like Set, but it stops waiting and returns the context error
+// if the context is done before the value could be set.
+func (b *Bcache) SetCtx(ctx context.Context, key, val string, ttl int) error {
+	return b.setBytes(ctx, key, []byte(val), ttl)
+}
+
+// SetBytes sets byte slice value for the given key with the given ttl in second.
+// if ttl <= 0, the key will expired instantly.
+//
+// The value is not copied, the caller must not modify it after calling SetBytes.
+func (b *Bcache) SetBytes(key string, val []byte, ttl int) {
+	b.setBytes(context.Background(), key, val, ttl)
+}
+
+func (b *Bcache) setBytes(ctx context.Context, key string, val []byte, ttl int) error {
 	if ttl <= 0 {
-		b.Delete(key)
-		return
+		return b.DeleteCtx(ctx, key)
+	}
+	_, err := b.set(ctx, key, val, ttl)
+	return err
+}
+
+func (b *Bcache) set(ctx context.Context, key string, val []byte, ttl int) (int64, error) {
+	expired := time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	return expired, b.peer.Set(ctx, key, val, expired)
+}
+
+// SetNX sets value for the given key with the given ttl in second,
+// only if the key not exists.
+// if ttl <= 0, nothing will be set.
+//
+// It returns true if the value has been set.
+//
+// The check is atomic only within this peer. When other peers
+// set the same key at the same time, all of them could succeed and
+// the conflict will be resolved by the last writer wins rule:
+// the write with the newest hybrid logical clock version wins,
+// the one from the peer with bigger PeerID wins if the versions are equal.
+func (b *Bcache) SetNX(key, val string, ttl int) bool {
+	if ttl <= 0 {
+		return false
+	}
+	return b.setIf(key, []byte(val), ttl, func(cur []byte, exists bool) bool {
+		return !exists
+	})
+}
+
+// CompareAndSwap sets value for the given key with the given ttl in second,
+// only if the current value is equal to old.
+// if ttl <= 0, nothing will be set.
+//
+// It returns true if the value has been swapped.
+//
+// Like SetNX, the comparison is atomic only within this peer,
+// concurrent writes from other peers are resolved by the last writer wins rule.
+func (b *Bcache) CompareAndSwap(key, old, new string, ttl int) bool {
+	if ttl <= 0 {
+		return false
 	}
-	b.set(key, val, ttl)
+	return b.setIf(key, []byte(new), ttl, func(cur []byte, exists bool) bool {
+		return exists && string(cur) == old
+	})
 }
 
-func (b *Bcache) set(key, val string, ttl int) int64 {
+func (b *Bcache) setIf(key string, val []byte, ttl int, cond func(cur []byte, exists bool) bool) bool {
 	expired := time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
-	b.peer.Set(key, val, expired)
-	return expired
+	ok, _ := b.peer.SetIf(context.Background(), key, val, expired, cond)
+	return ok
 }
 
 // Get gets value for the given key.
 //
 // It returns the value and true if the key exists
 func (b *Bcache) Get(key string) (string, bool) {
+	val, ok := b.peer.Get(key)
+	if !ok {
+		return "", false
+	}
+	return string(val), true
+}
+
+// GetBytes gets byte slice value for the given key.
+//
+// It returns the value and true if the key exists.
+// The returned slice is shared with the cache, the caller must not modify it.
+func (b *Bcache) GetBytes(key string) ([]byte, bool) {
 	return b.peer.Get(key)
 }
 
 // Delete the given key.
 //
 func (b *Bcache) Delete(key string) {
+	b.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx is like Delete, but it stops waiting and returns the context error
+// if the context is done before the key could be deleted.
+func (b *Bcache) DeleteCtx(ctx context.Context, key string) error {
+	deleteTs := time.Now().Add(b.deletionDelay).UnixNano()
+	_, err := b.peer.Delete(ctx, key, deleteTs)
+	return err
+}
+
+// Invalidate removes the value of the given key from all of the peers.
+//
+// Unlike Delete, the tombstone is sent to the other peers even if the key
+// doesn't exist in this peer, e.g.: it has been evicted or never been read here,
+// and the tombstone doesn't carry the old value, so the value is dropped
+// by every peer as soon as it receives the tombstone.
+// The tombstone is kept for the DeletionDelay, to win against the older
+// values which are still being gossiped.
+func (b *Bcache) Invalidate(key string) {
+	b.InvalidateCtx(context.Background(), key)
+}
+
+// InvalidateCtx is like Invalidate, but it stops waiting and returns the context error
+// if the context is done before the key could be invalidated.
+func (b *Bcache) InvalidateCtx(ctx context.Context, key string) error {
 	deleteTs := time.Now().Add(b.deletionDelay).UnixNano()
-	b.peer.Delete(key, deleteTs)
+	return b.peer.Invalidate(ctx, key, deleteTs)
+}
+
+// SetMulti sets values of the given keys with the given ttl in second.
+// if ttl <= 0, the keys will expired instantly.
+//
+// All of the values are sent to the other peers in one gossip message,
+// which is much cheaper than calling Set for every key.
+func (b *Bcache) SetMulti(items map[string]string, ttl int) {
+	if len(items) == 0 {
+		return
+	}
+	if ttl <= 0 {
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		b.DeleteMulti(keys)
+		return
+	}
+
+	vals := make(map[string][]byte, len(items))
+	for key, val := range items {
+		vals[key] = []byte(val)
+	}
+	expired := time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	b.peer.SetMulti(context.Background(), vals, expired)
+}
+
+// GetMulti gets values of the given keys.
+//
+// It returns the values of the existing keys,
+// non existing keys are not included in the returned map.
+func (b *Bcache) GetMulti(keys []string) map[string]string {
+	vals := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if val, ok := b.peer.Get(key); ok {
+			vals[key] = string(val)
+		}
+	}
+	return vals
+}
+
+// DeleteMulti deletes the given keys.
+//
+// All of the deletions are sent to the other peers in one gossip message.
+func (b *Bcache) DeleteMulti(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	deleteTs := time.Now().Add(b.deletionDelay).UnixNano()
+	b.peer.DeleteMulti(context.Background(), keys, deleteTs)
+}
+
+// Touch updates the ttl of the given key in second,
+// without resending the value to the other peers.
+// if ttl <= 0, the key will expired instantly.
+//
+// It returns false if the key not exists
+func (b *Bcache) Touch(key string, ttl int) bool {
+	return b.ExpireAt(key, time.Now().Add(time.Duration(ttl)*time.Second))
+}
+
+// ExpireAt sets the expiration time of the given key,
+// without resending the value to the other peers.
+//
+// It returns false if the key not exists
+func (b *Bcache) ExpireAt(key string, expired time.Time) bool {
+	ok, _ := b.peer.Touch(context.Background(), key, expired.UnixNano())
+	return ok
+}
+
+// Watch streams the changes of the keys with the given prefix,
+// empty prefix watches all of the keys.
+// It covers both the changes made by this peer and by the other peers.
+//
+// The returned channel is closed when the context is done, or the cache is closed.
+// Every watcher has a buffer of Config.WatchBufferSize events, the new events
+// are dropped when the buffer is full, and Event.Dropped of the next event
+// tells how many of them have been dropped.
+func (b *Bcache) Watch(ctx context.Context, prefix string) <-chan Event {
+	return b.peer.cc.watch.watch(ctx, prefix)
+}
+
+// UsedBytes returns total size in bytes of the keys and values in this cache,
+// the one which is limited by Config.MaxBytes.
+func (b *Bcache) UsedBytes() int64 {
+	return b.peer.cc.usedBytes()
+}
+
+// AddPeers connects to the given peers in host:port format,
+// in addition to the peers this peer already knows.
+// The connections are retried in the background until they are forgotten.
+//
+// It returns error if an address is invalid, the valid addresses are still added.
+func (b *Bcache) AddPeers(addrs []string) error {
+	errs := b.router.ConnectionMaker.InitiateConnections(addrs, false)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ForgetPeer stops connecting to the peer of the given address,
+// which was added by Config.Peers, AddPeers, or the PeerProvider.
+// The peer is still known by this peer as long as it is reachable through the other peers.
+func (b *Bcache) ForgetPeer(addr string) {
+	b.router.ConnectionMaker.ForgetConnections([]string{addr})
+}
+
+// Stats returns snapshot of the counters of this cache.
+// The counters are read one by one without stopping the cache,
+// so they could be slightly inconsistent with each other.
+func (b *Bcache) Stats() Stats {
+	st := b.peer.snapshot()
+	st.FillerCalls = atomic.LoadUint64(&b.fillerStats.calls)
+	st.FillerErrors = atomic.LoadUint64(&b.fillerStats.errors)
+	st.FillerSharedWaits = atomic.LoadUint64(&b.fillerStats.sharedWaits)
+	return st
 }
 
 // Filler defines func to be called when the given key is not exists
 type Filler func(key string) (val string, err error)
 
+// FillerCtx defines context aware func to be called when the given key is not exists
+type FillerCtx func(ctx context.Context, key string) (val string, err error)
+
 // GetWithFiller gets value for the given key and fill the cache
 // if the given key is not exists.
 //
@@ -146,21 +406,62 @@ func (b *Bcache) GetWithFiller(key string, filler Filler, ttl int) (string, erro
 		return "", ErrNilFiller
 	}
 
+	return b.GetWithFillerCtx(context.Background(), key, func(ctx context.Context, key string) (string, error) {
+		return filler(key)
+	}, ttl)
+}
+
+// GetWithFillerCtx is like GetWithFiller, but the given context is passed to the filler,
+// and it stops waiting and returns the context error if the context is done
+// before the value is available.
+//
+// The filler is called with the context of the caller which starts the cache filling,
+// the other callers waiting for the same key share its result, including its error.
+// The value returned by the filler is cached even if that caller stops waiting.
+func (b *Bcache) GetWithFillerCtx(ctx context.Context, key string, filler FillerCtx, ttl int) (string, error) {
+	if filler == nil {
+		return "", ErrNilFiller
+	}
+
+	val, err := b.getWithFiller(ctx, key, func(ctx context.Context, key string) ([]byte, error) {
+		val, err := filler(ctx, key)
+		return []byte(val), err
+	}, ttl)
+	if err != nil {
+		return "", err
+	}
+	return string(val), nil
+}
+
+// getWithFiller is the byte slice version of GetWithFillerCtx
+func (b *Bcache) getWithFiller(ctx context.Context, key string, filler func(ctx context.Context, key string) ([]byte, error), ttl int) ([]byte, error) {
 	// get value from cache
-	val, ok := b.Get(key)
+	val, ok := b.GetBytes(key)
 	if ok {
 		return val, nil
 	}
 
 	// construct singleflight filler
+	var called bool
 	flightFn := func() (interface{}, error) {
-		val, err := filler(key)
+		called = true
+		atomic.AddUint64(&b.fillerStats.calls, 1)
+
+		start := time.Now()
+		val, err := filler(ctx, key)
+		b.metrics.FillerDone(time.Since(start), err)
 		if err != nil {
+			atomic.AddUint64(&b.fillerStats.errors, 1)
 			b.logger.Errorf("filler failed: %v", err)
 			return nil, err
 		}
 
-		expired := b.set(key, val, ttl)
+		// the value is shared by all of the waiters,
+		// store it even when the caller which starts the filling is gone
+		expired, err := b.set(context.Background(), key, val, ttl)
+		if err != nil {
+			return nil, err
+		}
 
 		return value{
 			value:   val,
@@ -169,20 +470,67 @@ func (b *Bcache) GetWithFiller(key string, filler Filler, ttl int) (string, erro
 	}
 
 	// call the filler
-	valueIf, err, _ := b.flight.Do(key, func() (interface{}, error) {
-		return flightFn()
-	})
-	if err != nil {
-		return "", err
+	select {
+	case res := <-b.flight.DoChan(key, flightFn):
+		// flightFn of the other caller has been used
+		if !called {
+			atomic.AddUint64(&b.fillerStats.sharedWaits, 1)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		// return the value
+		return res.Val.(value).value, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-
-	// return the value
-	value := valueIf.(value)
-	return value.value, nil
 }
 
-// Close closes the cache, free all the resource
+// Close closes the cache, free all the resource.
+// It is CloseCtx which spends at most 5 seconds to hand off the entries.
 func (b *Bcache) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+
+	return b.CloseCtx(ctx)
+}
+
+// CloseCtx closes the cache gracefully:
+//   - the writes which are in progress are finished, the later writes return ErrClosed
+//   - the keys written by this cache are sent to one of the connected peers,
+//     so the recent writes are not lost if they haven't been gossiped yet
+//   - the background goroutines are stopped, and the watchers are closed
+//
+// The context bounds the time spent for the handoff, the cache is always closed
+// even if the handoff is not finished, in which case the context error is returned.
+// The network connections are kept by the mesh router, but the received gossip is ignored.
+//
+// It returns ErrClosed if the cache has been closed.
+func (b *Bcache) CloseCtx(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return ErrClosed
+	}
+
+	if b.discovery != nil {
+		b.discovery.stop()
+	}
+	b.janitor.stop()
+	b.membership.stop()
+	b.peer.stop()
+
+	err := b.peer.handoff(ctx, reachablePeers(b.router))
+	if err != nil {
+		b.logger.Errorf("failed to hand off the entries: %v", err)
+	}
+
+	b.peer.cc.close()
+
+	// stop connecting to the peers
+	b.router.ConnectionMaker.ForgetConnections(b.router.ConnectionMaker.Targets(false))
+
 	b.logger.Printf("mesh router stopping")
-	return b.router.Stop()
+	if stopErr := b.router.Stop(); err == nil {
+		err = stopErr
+	}
+	return err
 }
@@ -0,0 +1,442 @@
+package bcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+// newLocalBcache creates Bcache without mesh router,
+// it could be used to test the local behavior of bcache
+func newLocalBcache(t *testing.T) *Bcache {
+	return newLocalBcacheFromConfig(t, Config{MaxKeys: 100})
+}
+
+func newLocalBcacheFromConfig(t *testing.T, cfg Config) *Bcache {
+	cfg.PeerID = 1
+	require.NoError(t, cfg.setDefault())
+
+	p, err := newPeer(mesh.PeerName(cfg.PeerID), cfg)
+	require.NoError(t, err)
+
+	return &Bcache{
+		peer:    p,
+		logger:  cfg.Logger,
+		metrics: cfg.Metrics,
+	}
+}
+
+func TestBytes(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	bc.SetBytes("key", []byte{0, 1, 2}, 60)
+
+	got, ok := bc.GetBytes("key")
+	require.True(t, ok)
+	require.Equal(t, []byte{0, 1, 2}, got)
+
+	// string API sees the same value
+	str, ok := bc.Get("key")
+	require.True(t, ok)
+	require.Equal(t, string([]byte{0, 1, 2}), str)
+}
+
+func TestTouch(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	require.False(t, bc.Touch("key", 60))
+
+	bc.Set("key", "val", 60)
+	require.True(t, bc.Touch("key", 120))
+
+	val, ok := bc.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "val", val)
+
+	// expire it
+	require.True(t, bc.ExpireAt("key", time.Now().Add(-time.Second)))
+	_, ok = bc.Get("key")
+	require.False(t, ok)
+	require.False(t, bc.Touch("key", 60))
+
+	// deleted key couldn't be touched
+	bc.Set("deleted", "val", 60)
+	bc.Delete("deleted")
+	require.False(t, bc.Touch("deleted", 60))
+}
+
+func TestInvalidateLocal(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	bc.Set("key", "val", 60)
+	require.NoError(t, bc.InvalidateCtx(context.Background(), "key"))
+	_, ok := bc.Get("key")
+	require.False(t, ok)
+	require.False(t, bc.Touch("key", 60))
+
+	// unknown key leaves the tombstone
+	bc.Invalidate("unknown")
+	_, ok = bc.Get("unknown")
+	require.False(t, ok)
+	require.Equal(t, uint64(2), bc.Stats().Deletes)
+
+	bc.Set("key", "new", 60)
+	val, ok := bc.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "new", val)
+}
+
+func TestDeleteByPrefixLocal(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	bc.Set("user/1", "val", 60)
+	bc.Set("user/2", "val", 60)
+	bc.Set("session/1", "val", 60)
+
+	require.NoError(t, bc.DeleteByPrefix("user/"))
+	_, ok := bc.Get("user/1")
+	require.False(t, ok)
+	_, ok = bc.Get("user/2")
+	require.False(t, ok)
+	_, ok = bc.Get("session/1")
+	require.True(t, ok)
+
+	// set after the deletion
+	bc.Set("user/1", "new", 60)
+	require.NoError(t, bc.Flush())
+	bc.Set("user/2", "new", 60)
+
+	_, ok = bc.Get("user/1")
+	require.False(t, ok)
+	_, ok = bc.Get("session/1")
+	require.False(t, ok)
+	val, ok := bc.Get("user/2")
+	require.True(t, ok)
+	require.Equal(t, "new", val)
+
+	legacy := newLocalBcacheFromConfig(t, Config{MaxKeys: 100, LegacyEncoding: true})
+	require.Error(t, legacy.Flush())
+}
+
+// the callbacks could use the cache
+func TestCallbacksWrite(t *testing.T) {
+	var (
+		bc        *Bcache
+		evictedCh = make(chan string, 10)
+		expiredCh = make(chan string, 10)
+	)
+	bc = newLocalBcacheFromConfig(t, Config{
+		MaxKeys:    1,
+		ShardCount: 1,
+		OnEvict: func(key string, val []byte) {
+			bc.Delete("derived-" + key)
+			evictedCh <- key
+		},
+		OnExpire: func(key string, val []byte) {
+			bc.Set("expired-"+key, "val", 60)
+			expiredCh <- key
+		},
+	})
+
+	bc.Set("key1", "val", 60)
+	bc.Set("key2", "val", 60) // evicts key1
+	bc.Set("key3", "val", 60) // evicts key2
+	require.Equal(t, "key1", <-evictedCh)
+	require.Equal(t, "key2", <-evictedCh)
+
+	bc.Set("key4", "val", 60)
+	require.True(t, bc.ExpireAt("key4", time.Now().Add(-time.Second)))
+	_, ok := bc.Get("key4")
+	require.False(t, ok)
+	require.Equal(t, "key4", <-expiredCh)
+}
+
+func TestSetNX(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	require.False(t, bc.SetNX("key", "val1", 0))
+	require.True(t, bc.SetNX("key", "val1", 60))
+	require.False(t, bc.SetNX("key", "val2", 60))
+
+	val, ok := bc.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "val1", val)
+
+	// deleted key could be set again
+	bc.Delete("key")
+	require.True(t, bc.SetNX("key", "val2", 60))
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	require.False(t, bc.CompareAndSwap("key", "", "val1", 60))
+
+	bc.Set("key", "val1", 60)
+	require.False(t, bc.CompareAndSwap("key", "val2", "val3", 60))
+	require.False(t, bc.CompareAndSwap("key", "val1", "val2", 0))
+	require.True(t, bc.CompareAndSwap("key", "val1", "val2", 60))
+
+	val, ok := bc.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "val2", val)
+
+	// the conditions don't count as reads
+	stats := bc.Stats()
+	require.False(t, bc.CompareAndSwap("key", "val1", "val3", 60))
+	require.False(t, bc.SetNX("key", "val3", 60))
+	require.True(t, bc.SetNX("other", "val", 60))
+	require.Equal(t, stats.Hits, bc.Stats().Hits)
+	require.Equal(t, stats.Misses, bc.Stats().Misses)
+}
+
+func TestSetNXConcurrent(t *testing.T) {
+	const numWorkers = 50
+
+	var (
+		bc      = newLocalBcache(t)
+		wg      sync.WaitGroup
+		success int32
+	)
+
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if bc.SetNX("key", fmt.Sprintf("val-%d", i), 60) {
+				atomic.AddInt32(&success, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), success)
+}
+
+func TestMulti(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	bc.SetMulti(map[string]string{
+		"key1": "val1",
+		"key2": "val2",
+		"key3": "val3",
+	}, 60)
+
+	got := bc.GetMulti([]string{"key1", "key2", "key3", "key4"})
+	require.Equal(t, map[string]string{
+		"key1": "val1",
+		"key2": "val2",
+		"key3": "val3",
+	}, got)
+
+	bc.DeleteMulti([]string{"key1", "key3", "key4"})
+	got = bc.GetMulti([]string{"key1", "key2", "key3", "key4"})
+	require.Equal(t, map[string]string{"key2": "val2"}, got)
+
+	// ttl <= 0 deletes the keys
+	bc.SetMulti(map[string]string{"key2": "val2"}, 0)
+	require.Empty(t, bc.GetMulti([]string{"key2"}))
+}
+
+func TestSetCtx(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	require.NoError(t, bc.SetCtx(context.Background(), "key", "val", 60))
+	val, ok := bc.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "val", val)
+
+	// block the peer loop
+	block := make(chan struct{})
+	bc.peer.actionCh <- func() {
+		<-block
+	}
+	defer close(block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	require.Equal(t, context.DeadlineExceeded, bc.SetCtx(ctx, "key", "val2", 60))
+	require.Equal(t, context.DeadlineExceeded, bc.DeleteCtx(ctx, "key"))
+
+	val, ok = bc.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "val", val)
+}
+
+func TestGetWithFillerCtx(t *testing.T) {
+	type ctxKey struct{}
+
+	bc := newLocalBcache(t)
+
+	// filler receives the context
+	ctx := context.WithValue(context.Background(), ctxKey{}, "val")
+	val, err := bc.GetWithFillerCtx(ctx, "key", func(ctx context.Context, key string) (string, error) {
+		return ctx.Value(ctxKey{}).(string), nil
+	}, 60)
+	require.NoError(t, err)
+	require.Equal(t, "val", val)
+
+	// slow filler abandoned on cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = bc.GetWithFillerCtx(ctx, "slow", func(ctx context.Context, key string) (string, error) {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(10 * time.Second):
+			return "val", nil
+		}
+	}, 60)
+	require.Equal(t, context.Canceled, err)
+
+	_, ok := bc.Get("slow")
+	require.False(t, ok)
+
+	// value is stored although the caller is gone after the filler returns
+	ctx, cancel = context.WithCancel(context.Background())
+	bc.GetWithFillerCtx(ctx, "cancelled", func(ctx context.Context, key string) (string, error) {
+		cancel()
+		return "val", nil
+	}, 60)
+	require.Eventually(t, func() bool {
+		val, ok := bc.Get("cancelled")
+		return ok && val == "val"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = bc.GetWithFillerCtx(context.Background(), "key", nil, 60)
+	require.Equal(t, ErrNilFiller, err)
+}
+
+func TestUsedBytes(t *testing.T) {
+	bc := newLocalBcache(t)
+	require.Equal(t, int64(0), bc.UsedBytes())
+
+	bc.Set("key1", "val1", 60)
+	bc.SetBytes("key2", make([]byte, 100), 60)
+	require.Equal(t, int64(4+4+4+100), bc.UsedBytes())
+}
+
+func TestStats(t *testing.T) {
+	bc := newLocalBcacheFromConfig(t, Config{MaxKeys: 2, ShardCount: 1})
+
+	bc.Set("key1", "val1", 60)
+	bc.SetMulti(map[string]string{"key2": "val2", "key3": "val3"}, 60) // evicts key1
+	bc.Get("key1")
+	bc.Get("key2")
+	bc.Delete("key2")
+	bc.Delete("key4")
+	bc.Get("key2") // removes the tombstone, there is no deletion delay
+
+	_, err := bc.GetWithFiller("key5", func(key string) (string, error) {
+		return "", fmt.Errorf("failed")
+	}, 60)
+	require.Error(t, err)
+
+	// gossip
+	msg := bc.peer.cc.newMessage(1)
+	msg.add("key6", entry{
+		Val:     []byte("val6"),
+		Expired: time.Now().Add(time.Hour).UnixNano(),
+		Version: version{Clock: 1, Origin: 2},
+	})
+	buf := msg.Encode()[0]
+	_, err = bc.peer.OnGossipBroadcast(mesh.PeerName(2), buf)
+	require.NoError(t, err)
+
+	st := bc.Stats()
+	require.Equal(t, Stats{
+		Hits:              1,
+		Misses:            3, // key1, key2, and key5 before calling the filler
+		Sets:              3,
+		Deletes:           1,
+		Evictions:         1,
+		Expired:           1,
+		FillerCalls:       1,
+		FillerErrors:      1,
+		GossipMessagesIn:  1,
+		GossipBytesIn:     uint64(len(buf)),
+		GossipMessagesOut: 1,
+		GossipBytesOut:    uint64(len(buf)),
+		Keys:              2,
+		Bytes:             bc.UsedBytes(),
+	}, st)
+
+	// expired
+	require.True(t, bc.ExpireAt("key6", time.Now().Add(-time.Second)))
+	bc.Get("key6")
+	require.Equal(t, uint64(2), bc.Stats().Expired)
+}
+
+func TestStatsFillerSharedWaits(t *testing.T) {
+	const numCallers = 10
+
+	bc := newLocalBcache(t)
+
+	var (
+		wg      sync.WaitGroup
+		release = make(chan struct{})
+		started = make(chan struct{})
+	)
+	filler := func(key string) (string, error) {
+		close(started)
+		<-release
+		return "val", nil
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bc.GetWithFiller("key", filler, 60)
+	}()
+	<-started
+
+	for i := 1; i < numCallers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bc.GetWithFiller("key", filler, 60)
+		}()
+	}
+
+	// wait for the other callers to join the running filler
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	st := bc.Stats()
+	require.Equal(t, uint64(1), st.FillerCalls)
+	require.Equal(t, uint64(numCallers-1), st.FillerSharedWaits)
+}
+
+func TestWriteWithOptions(t *testing.T) {
+	bc := newLocalBcache(t)
+	ctx := context.Background()
+
+	res, err := bc.SetWithOptions(ctx, "key", "val", 60, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, WriteResult{Written: true}, res)
+
+	val, ok := bc.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "val", val)
+
+	res, err = bc.DeleteWithOptions(ctx, "key", WriteOptions{})
+	require.NoError(t, err)
+	require.True(t, res.Written)
+
+	_, ok = bc.Get("key")
+	require.False(t, ok)
+
+	// nothing to delete
+	res, err = bc.DeleteWithOptions(ctx, "unknown", WriteOptions{Acks: 1})
+	require.NoError(t, err)
+	require.False(t, res.Written)
+}
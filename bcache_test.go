@@ -3,14 +3,36 @@
 package bcache
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// newTestBcache creates Bcache listening on the given address and joining the given peers
+func newTestBcache(t *testing.T, id uint64, addr string, peers []string) *Bcache {
+	return newTestBcacheFromConfig(t, Config{
+		PeerID:     id,
+		ListenAddr: addr,
+		Peers:      peers,
+	})
+}
+
+func newTestBcacheFromConfig(t *testing.T, cfg Config) *Bcache {
+	if cfg.MaxKeys == 0 {
+		cfg.MaxKeys = 1000
+	}
+	cfg.Logger = &nopLogger{}
+
+	bc, err := New(cfg)
+	require.NoError(t, err)
+	return bc
+}
+
 // Three nodes
 // - peer 2 & 3 could read what peer 1 write
 // - peer 2 could update that value
@@ -176,6 +198,392 @@ func TestJoinLater(t *testing.T) {
 	}
 }
 
+// Second peer join after first peer set the keys,
+// the keys are exchanged by the anti entropy repair
+func TestJoinLaterAntiEntropy(t *testing.T) {
+	const (
+		numKeys = 100
+	)
+	var (
+		keyvals = make(map[string]string)
+		ttl     = 60
+	)
+	for i := 0; i < numKeys; i++ {
+		k := fmt.Sprintf("key_%d", i)
+		v := fmt.Sprintf("val_%d", i)
+		keyvals[k] = v
+	}
+
+	// create first node
+	b1 := newTestBcacheFromConfig(t, Config{
+		PeerID:      1,
+		ListenAddr:  "127.0.0.1:12350",
+		Peers:       nil,
+		AntiEntropy: true,
+	})
+	defer b1.Close()
+
+	// set values
+	for k, v := range keyvals {
+		b1.Set(k, v, ttl)
+	}
+
+	b2 := newTestBcacheFromConfig(t, Config{
+		PeerID:      2,
+		ListenAddr:  "127.0.0.1:12351",
+		Peers:       []string{"127.0.0.1:12350"},
+		AntiEntropy: true,
+	})
+	defer b2.Close()
+
+	// wait for it to propagate
+	time.Sleep(2 * time.Second)
+
+	// check we could get it from b2
+	for k, v := range keyvals {
+		got, ok := b2.Get(k)
+		require.True(t, ok)
+		require.Equal(t, v, got)
+	}
+}
+
+// TTL update propagated to other peers
+func TestTouchPropagation(t *testing.T) {
+	b1 := newTestBcache(t, 1, "127.0.0.1:12352", nil)
+	defer b1.Close()
+
+	b2 := newTestBcache(t, 2, "127.0.0.1:12353", []string{"127.0.0.1:12352"})
+	defer b2.Close()
+
+	// wait for the peers to be connected
+	time.Sleep(time.Second)
+
+	b1.Set("key", "val", 60)
+	time.Sleep(time.Second)
+
+	val, ok := b2.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "val", val)
+
+	// shorten the ttl from b1
+	require.True(t, b1.ExpireAt("key", time.Now().Add(time.Second)))
+
+	// wait for it to propagate and expire
+	time.Sleep(2 * time.Second)
+
+	_, ok = b2.Get("key")
+	require.False(t, ok)
+}
+
+func TestPeers(t *testing.T) {
+	b1 := newTestBcache(t, 1, "127.0.0.1:12360", nil)
+	defer b1.Close()
+
+	require.Empty(t, b1.Peers())
+
+	b2 := newTestBcache(t, 2, "127.0.0.1:12361", []string{"127.0.0.1:12360"})
+	defer b2.Close()
+
+	b3 := newTestBcache(t, 3, "127.0.0.1:12362", []string{"127.0.0.1:12360"})
+	defer b3.Close()
+
+	// wait for the peers to be connected
+	time.Sleep(2 * time.Second)
+
+	b2.Set("key2", "val", 60)
+	b3.Set("key3", "val", 60)
+	time.Sleep(time.Second)
+
+	peers := b1.Peers()
+	require.Len(t, peers, 2)
+	for i, nickName := range []string{"127.0.0.1:12361", "127.0.0.1:12362"} {
+		require.Equal(t, uint64(i+2), peers[i].ID)
+		require.Equal(t, nickName, peers[i].NickName)
+		require.Equal(t, PeerConnected, peers[i].State)
+		require.NotEmpty(t, peers[i].Address)
+		require.False(t, peers[i].LastSeen.IsZero())
+	}
+
+	// discovered by b1
+	peers = b2.Peers()
+	require.Len(t, peers, 2)
+	require.Equal(t, uint64(1), peers[0].ID)
+	require.Equal(t, uint64(3), peers[1].ID)
+}
+
+func TestPeerJoin(t *testing.T) {
+	var (
+		mux    sync.Mutex
+		joined []uint64
+	)
+	b1 := newTestBcacheFromConfig(t, Config{
+		PeerID:     1,
+		ListenAddr: "127.0.0.1:12363",
+		Peers:      nil,
+		OnPeerJoin: func(peerID uint64) {
+			mux.Lock()
+			joined = append(joined, peerID)
+			mux.Unlock()
+		},
+	})
+	defer b1.Close()
+
+	b2 := newTestBcache(t, 2, "127.0.0.1:12364", []string{"127.0.0.1:12363"})
+	defer b2.Close()
+
+	require.Eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(joined) == 1
+	}, 3*time.Second, 100*time.Millisecond)
+	require.Equal(t, []uint64{2}, joined)
+}
+
+func TestAddPeers(t *testing.T) {
+	b1 := newTestBcache(t, 1, "127.0.0.1:12365", nil)
+	defer b1.Close()
+
+	b2 := newTestBcache(t, 2, "127.0.0.1:12366", nil)
+	defer b2.Close()
+
+	b3 := newTestBcacheFromConfig(t, Config{
+		PeerID:     3,
+		ListenAddr: "127.0.0.1:12367",
+		Peers:      nil,
+		PeerProvider: PeerProviderFunc(func(ctx context.Context) ([]string, error) {
+			return []string{"127.0.0.1:12365"}, nil
+		}),
+	})
+	defer b3.Close()
+
+	require.Error(t, b2.AddPeers([]string{"invalid"}))
+	require.NoError(t, b2.AddPeers([]string{"127.0.0.1:12365"}))
+
+	// wait for the peers to be connected
+	time.Sleep(2 * time.Second)
+
+	b1.Set("key", "val", 60)
+	time.Sleep(time.Second)
+
+	for _, bc := range []*Bcache{b2, b3} {
+		val, ok := bc.Get("key")
+		require.True(t, ok)
+		require.Equal(t, "val", val)
+	}
+}
+
+// peers with different password can't exchange the entries
+func TestPassword(t *testing.T) {
+	newBcache := func(id uint64, addr, password string, peers []string) *Bcache {
+		return newTestBcacheFromConfig(t, Config{
+			PeerID:     id,
+			ListenAddr: addr,
+			Peers:      peers,
+			Password:   password,
+		})
+	}
+
+	b1 := newBcache(1, "127.0.0.1:12368", "secret", nil)
+	defer b1.Close()
+
+	b2 := newBcache(2, "127.0.0.1:12369", "secret", []string{"127.0.0.1:12368"})
+	defer b2.Close()
+
+	wrong := newBcache(3, "127.0.0.1:12370", "wrong", []string{"127.0.0.1:12368"})
+	defer wrong.Close()
+
+	none := newBcache(4, "127.0.0.1:12371", "", []string{"127.0.0.1:12368"})
+	defer none.Close()
+
+	// wait for the peers to be connected
+	time.Sleep(2 * time.Second)
+
+	b1.Set("key1", "val1", 60)
+	wrong.Set("key2", "val2", 60)
+	none.Set("key3", "val3", 60)
+	time.Sleep(time.Second)
+
+	val, ok := b2.Get("key1")
+	require.True(t, ok)
+	require.Equal(t, "val1", val)
+
+	for _, bc := range []*Bcache{wrong, none} {
+		_, ok = bc.Get("key1")
+		require.False(t, ok)
+		require.Empty(t, bc.Peers())
+	}
+	for _, bc := range []*Bcache{b1, b2} {
+		for _, key := range []string{"key2", "key3"} {
+			_, ok = bc.Get(key)
+			require.False(t, ok)
+		}
+		require.Len(t, bc.Peers(), 1)
+	}
+}
+
+func TestClose(t *testing.T) {
+	b1 := newTestBcache(t, 1, "127.0.0.1:12372", nil)
+
+	b2 := newTestBcache(t, 2, "127.0.0.1:12373", []string{"127.0.0.1:12372"})
+	defer b2.Close()
+
+	// wait for the peers to be connected
+	time.Sleep(time.Second)
+
+	ch := b1.Watch(context.Background(), "")
+	b1.Set("key", "val", 60)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, b1.CloseCtx(ctx))
+
+	// the closed cache doesn't hang
+	require.Equal(t, ErrClosed, b1.SetCtx(context.Background(), "key2", "val", 60))
+	require.Equal(t, ErrClosed, b1.DeleteCtx(context.Background(), "key"))
+	require.Equal(t, ErrClosed, b1.Close())
+	b1.Set("key2", "val", 60)
+	_, ok := b1.Get("key2")
+	require.False(t, ok)
+
+	// watcher is closed after the buffered events
+	<-ch
+	_, ok = <-ch
+	require.False(t, ok)
+
+	// the write has been handed off
+	time.Sleep(100 * time.Millisecond)
+	val, ok := b2.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "val", val)
+}
+
+func TestWriteAcks(t *testing.T) {
+	b1 := newTestBcache(t, 1, "127.0.0.1:12374", nil)
+	defer b1.Close()
+
+	b2 := newTestBcache(t, 2, "127.0.0.1:12375", []string{"127.0.0.1:12374"})
+	defer b2.Close()
+
+	b3 := newTestBcache(t, 3, "127.0.0.1:12376", []string{"127.0.0.1:12374"})
+	defer b3.Close()
+
+	// wait for the peers to be connected
+	time.Sleep(2 * time.Second)
+
+	ctx := context.Background()
+	opts := WriteOptions{Acks: 2, AckTimeout: time.Second}
+
+	res, err := b1.SetWithOptions(ctx, "key", "val", 60, opts)
+	require.NoError(t, err)
+	require.True(t, res.Written)
+	require.ElementsMatch(t, []uint64{2, 3}, res.AckedBy)
+
+	// acknowledged peers have the value
+	for _, bc := range []*Bcache{b2, b3} {
+		val, ok := bc.Get("key")
+		require.True(t, ok)
+		require.Equal(t, "val", val)
+	}
+
+	res, err = b2.DeleteWithOptions(ctx, "key", opts)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []uint64{1, 3}, res.AckedBy)
+	for _, bc := range []*Bcache{b1, b3} {
+		_, ok := bc.Get("key")
+		require.False(t, ok)
+	}
+
+	// there are only 2 other peers
+	res, err = b1.SetWithOptions(ctx, "key", "val", 60, WriteOptions{Acks: 3, AckTimeout: time.Second})
+	require.True(t, errors.Is(err, ErrNotAcked))
+	require.True(t, res.Written)
+}
+
+func TestInvalidate(t *testing.T) {
+	b1 := newTestBcache(t, 1, "127.0.0.1:12377", nil)
+	defer b1.Close()
+
+	b2 := newTestBcache(t, 2, "127.0.0.1:12378", []string{"127.0.0.1:12377"})
+	defer b2.Close()
+
+	b3 := newTestBcache(t, 3, "127.0.0.1:12379", []string{"127.0.0.1:12377"})
+	defer b3.Close()
+
+	// wait for the peers to be connected
+	time.Sleep(2 * time.Second)
+
+	b1.Set("password", "old", 600)
+	time.Sleep(time.Second)
+	for _, bc := range []*Bcache{b2, b3} {
+		val, ok := bc.Get("password")
+		require.True(t, ok)
+		require.Equal(t, "old", val)
+	}
+
+	// invalidated immediately on the peer which invalidates it
+	b3.Invalidate("password")
+	_, ok := b3.Get("password")
+	require.False(t, ok)
+
+	time.Sleep(time.Second)
+	for _, bc := range []*Bcache{b1, b2, b3} {
+		_, ok := bc.Get("password")
+		require.False(t, ok)
+	}
+
+	// the tombstone could be overwritten by the newer value
+	b2.Set("password", "new", 600)
+	time.Sleep(time.Second)
+	for _, bc := range []*Bcache{b1, b2, b3} {
+		val, ok := bc.Get("password")
+		require.True(t, ok)
+		require.Equal(t, "new", val)
+	}
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	b1 := newTestBcache(t, 1, "127.0.0.1:12380", nil)
+	defer b1.Close()
+
+	b2 := newTestBcache(t, 2, "127.0.0.1:12381", []string{"127.0.0.1:12380"})
+	defer b2.Close()
+
+	b3 := newTestBcache(t, 3, "127.0.0.1:12382", []string{"127.0.0.1:12380"})
+	defer b3.Close()
+
+	// wait for the peers to be connected
+	time.Sleep(2 * time.Second)
+
+	b1.Set("tenant-1/a", "val", 600)
+	b2.Set("tenant-1/b", "val", 600)
+	b3.Set("tenant-2/a", "val", 600)
+	time.Sleep(time.Second)
+
+	require.NoError(t, b3.DeleteByPrefix("tenant-1/"))
+	time.Sleep(time.Second)
+	for _, bc := range []*Bcache{b1, b2, b3} {
+		_, ok := bc.Get("tenant-1/a")
+		require.False(t, ok)
+		_, ok = bc.Get("tenant-1/b")
+		require.False(t, ok)
+		_, ok = bc.Get("tenant-2/a")
+		require.True(t, ok)
+	}
+
+	// the writes after the flush survive
+	require.NoError(t, b2.Flush())
+	time.Sleep(time.Second)
+	b1.Set("tenant-1/a", "new", 600)
+	time.Sleep(time.Second)
+	for _, bc := range []*Bcache{b1, b2, b3} {
+		_, ok := bc.Get("tenant-2/a")
+		require.False(t, ok)
+		val, ok := bc.Get("tenant-1/a")
+		require.True(t, ok)
+		require.Equal(t, "new", val)
+	}
+}
+
 func TestFiller(t *testing.T) {
 	var (
 		errFillerFailed = errors.New("filler failed")
@@ -1,104 +1,427 @@
 package bcache
 
 import (
-	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/hashicorp/golang-lru"
 	"github.com/weaveworks/mesh"
 )
 
 type cache struct {
-	peerID mesh.PeerName
-	mux    sync.RWMutex
-	cc     *lru.Cache
+	peerID   mesh.PeerName
+	shards   []*shard
+	wireOpts wireOptions
+
+	// onRemoteUpdate is called without holding the locks,
+	// after the received changes have been merged
+	onRemoteUpdate func(key string, origin uint64)
+
+	watch     *watchHub
+	callbacks *callbackQueue
+	metrics   Metrics
+	stats     cacheStats
+
+	// range tombstones of DeleteByPrefix and Flush
+	ranges *rangeTombstones
 }
 
-func newCache(maxKeys int) (*cache, error) {
-	cc, err := lru.New(maxKeys)
+func newCache(peerID mesh.PeerName, cfg Config) (*cache, error) {
+	if cfg.Metrics == nil {
+		cfg.Metrics = &nopMetrics{}
+	}
+
+	var (
+		watch     = newWatchHub(cfg.WatchBufferSize)
+		callbacks = newCallbackQueue()
+	)
+
+	// the user callbacks are called from the queue,
+	// so they could use the cache
+	if onEvict := cfg.OnEvict; onEvict != nil {
+		cfg.OnEvict = func(key string, val []byte) {
+			callbacks.push(func() {
+				onEvict(key, val)
+			})
+		}
+	}
+
+	// expired keys are also sent to the watchers
+	onExpire := cfg.OnExpire
+	cfg.OnExpire = func(key string, val []byte) {
+		if onExpire != nil {
+			callbacks.push(func() {
+				onExpire(key, val)
+			})
+		}
+		watch.publish(Event{
+			Type:   EventExpire,
+			Key:    key,
+			Value:  val,
+			Origin: uint64(peerID),
+		})
+	}
+
+	shards, err := newShards(cfg)
 	if err != nil {
 		return nil, err
 	}
+	if numBuckets := digestBuckets(cfg); numBuckets > 0 {
+		for _, sh := range shards {
+			sh.digest = make([]uint64, numBuckets)
+		}
+	}
+	callbacks.start()
 
 	return &cache{
-		cc: cc,
+		peerID:         peerID,
+		shards:         shards,
+		wireOpts:       cfg.wireOptions(),
+		onRemoteUpdate: cfg.OnRemoteUpdate,
+		watch:          watch,
+		callbacks:      callbacks,
+		metrics:        cfg.Metrics,
+		ranges:         newRangeTombstones(),
 	}, nil
 }
 
+// close stops notifying the watchers and calling the callbacks,
+// the callbacks which have been queued are called before it returns
+func (c *cache) close() {
+	c.callbacks.stop()
+	c.watch.close()
+}
+
+// shard returns the shard of the given key
+func (c *cache) shard(key string) *shard {
+	return c.shards[shardIndex(key, len(c.shards))]
+}
+
+// shardKeys groups the keys of the given entries by their shard index
+func (c *cache) shardKeys(entries map[string]entry) [][]string {
+	keys := make([][]string, len(c.shards))
+	for key := range entries {
+		i := shardIndex(key, len(c.shards))
+		keys[i] = append(keys[i], key)
+	}
+	return keys
+}
+
+// len returns number of the keys in the cache,
+// including the expired and deleted ones which are not removed yet
+func (c *cache) len() int {
+	var n int
+	for _, sh := range c.shards {
+		n += sh.len()
+	}
+	return n
+}
+
+// usedBytes returns total size of the keys and values in the cache,
+// including the expired and deleted ones which are not removed yet
+func (c *cache) usedBytes() int64 {
+	var n int64
+	for _, sh := range c.shards {
+		n += sh.usedBytes()
+	}
+	return n
+}
+
+// newMessage creates new message which encoded using this cache options
+func (c *cache) newMessage(numEntries int) *message {
+	m := newMessage(c.peerID, numEntries)
+	m.opts = c.wireOpts
+	m.metrics = c.metrics
+	m.stats = &c.stats
+	return m
+}
+
+// received records the gossip message received by the peer
+func (c *cache) received(size int) {
+	c.metrics.GossipReceived(size)
+	c.stats.received(size)
+}
+
+// snapshot returns the stats of the cache
+func (c *cache) snapshot() Stats {
+	st := Stats{
+		Hits:              atomic.LoadUint64(&c.stats.hits),
+		Misses:            atomic.LoadUint64(&c.stats.misses),
+		GossipMessagesIn:  atomic.LoadUint64(&c.stats.gossipMessagesIn),
+		GossipBytesIn:     atomic.LoadUint64(&c.stats.gossipBytesIn),
+		GossipMessagesOut: atomic.LoadUint64(&c.stats.gossipMessagesOut),
+		GossipBytesOut:    atomic.LoadUint64(&c.stats.gossipBytesOut),
+	}
+	for _, sh := range c.shards {
+		st.Evictions += atomic.LoadUint64(&sh.evictions)
+		st.Expired += atomic.LoadUint64(&sh.expired)
+		st.Keys += sh.len()
+		st.Bytes += sh.usedBytes()
+	}
+	return st
+}
+
 // value represent cache value
 type value struct {
-	value   string
-	expired int64 // expiration timestamp of the value
-	deleted int64 // deletion timestamp of the value
+	value   []byte
+	expired int64   // expiration timestamp of the value
+	deleted int64   // deletion timestamp of the value
+	version version // version of the last change
+}
+
+// removable returns true if the value already expired or deleted
+func (v *value) removable(now int64) bool {
+	return now >= v.expired || (now >= v.deleted && v.deleted > 0)
+}
+
+func (v *value) entry() entry {
+	return entry{
+		Val:     v.value,
+		Expired: v.expired,
+		Deleted: v.deleted,
+		Version: v.version,
+	}
 }
 
-// Set sets the value of a cache
-func (c *cache) Set(key, val string, expiredTimestamp, deleted int64) {
-	c.cc.Add(key, value{
-		value:   val,
-		expired: expiredTimestamp,
-		deleted: deleted,
+// Set sets the value of a cache.
+// The value is stored as is, the caller must not modify it afterwards.
+func (c *cache) Set(key string, e entry) {
+	c.shard(key).add(key, value{
+		value:   e.Val,
+		expired: e.Expired,
+		deleted: e.Deleted,
+		version: e.Version,
 	})
+}
+
+// SetIf sets the value of a cache only if cond returns true for the current value.
+// The check and set are atomic with the merges of the received data.
+// nil cond always sets the value.
+func (c *cache) SetIf(key string, e entry, cond func(cur []byte, exists bool) bool) bool {
+	sh := c.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
 
+	if cond != nil {
+		// peek the current value, so the condition doesn't count as a read
+		var cur []byte
+		val, ok := c.peek(key)
+		exists := ok && val.deleted <= 0 && !val.removable(time.Now().UnixNano())
+		if exists {
+			cur = val.value
+		}
+		if !cond(cur, exists) {
+			return false
+		}
+	}
+	c.Set(key, e)
+	return true
 }
 
 // Delete del the value of a cache.
-// returns true if the key exists in cache, false otherwise
-func (c *cache) Delete(key string, deleteTimestamp int64) (string, int64, bool) {
+// returns the deleted entry and true if the key exists in cache, false otherwise
+func (c *cache) Delete(key string, deleteTimestamp int64, ver version) (entry, bool) {
+	sh := c.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
 	val, ok := c.get(key)
 	if !ok {
-		return "", 0, false
+		return entry{}, false
 	}
-	c.Set(key, val.value, val.expired, deleteTimestamp)
+	e := val.entry()
+	e.Deleted = deleteTimestamp
+	e.Version = ver
+	c.Set(key, e)
 
-	return val.value, val.expired, true
+	return e, true
+}
+
+// Invalidate replaces the value of a cache with a tombstone which doesn't carry the value,
+// regardless whether the key exists in this cache.
+// The tombstone is kept until the given delete timestamp.
+// returns the tombstone entry.
+func (c *cache) Invalidate(key string, deleteTimestamp int64, ver version) entry {
+	sh := c.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	e := entry{
+		Expired: deleteTimestamp,
+		Deleted: deleteTimestamp,
+		Version: ver,
+	}
+	c.Set(key, e)
+	return e
+}
+
+// Touch updates the expiration timestamp of the given key.
+// It returns metadata only entry of the change and true if the key exists.
+func (c *cache) Touch(key string, expiredTimestamp int64, ver version) (entry, bool) {
+	sh := c.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	val, ok := c.get(key)
+	if !ok || val.deleted > 0 || val.removable(time.Now().UnixNano()) {
+		return entry{}, false
+	}
+
+	meta := entry{
+		Expired:  expiredTimestamp,
+		Version:  ver,
+		MetaOnly: true,
+		Base:     val.version,
+	}
+	e, _ := val.entry().merge(meta)
+	c.Set(key, e)
+
+	return meta, true
 }
 
 // Get gets cache value of the given key
 func (c *cache) get(key string) (*value, bool) {
-	cacheVal, ok := c.cc.Get(key)
+	val, ok := c.shard(key).get(key)
+	if !ok {
+		return nil, false
+	}
+	return &val, true
+}
+
+// peek gets cache value of the given key without updating the recentness
+func (c *cache) peek(key string) (*value, bool) {
+	val, ok := c.shard(key).peek(key)
 	if !ok {
 		return nil, false
 	}
-	val := cacheVal.(value)
 	return &val, true
 }
 
 // Get gets cache value of the given key
-func (c *cache) Get(key string) (string, bool) {
+func (c *cache) Get(key string) ([]byte, bool) {
 	val, ok := c.get(key)
 	if !ok {
-		return "", false
+		c.miss()
+		return nil, false
 	}
 
-	now := time.Now().UnixNano()
-
-	if now >= val.expired || (now >= val.deleted && val.deleted > 0) {
+	if now := time.Now().UnixNano(); val.removable(now) {
 		// delete the key if:
 		// - expired
 		// - deleted
-		c.cc.Remove(key)
-		return "", false
+		c.shard(key).expire(key, now)
+		c.miss()
+		return nil, false
+	}
+
+	if val.deleted > 0 {
+		c.miss()
+		return val.value, false
 	}
+	c.metrics.Hit()
+	atomic.AddUint64(&c.stats.hits, 1)
+	return val.value, true
+}
 
-	return val.value, val.deleted <= 0
+func (c *cache) miss() {
+	c.metrics.Miss()
+	atomic.AddUint64(&c.stats.misses, 1)
 }
 
 func (c *cache) Messages() *message {
-	m := newMessage(c.peerID, c.cc.Len())
+	m := c.newMessage(c.len())
 
-	for _, k := range c.cc.Keys() {
-		key := k.(string)
-		cacheVal, ok := c.get(key)
-		if !ok {
-			continue
+	for _, sh := range c.shards {
+		for _, key := range sh.keys() {
+			cacheVal, ok := c.peek(key)
+			if !ok {
+				continue
+			}
+			m.add(key, cacheVal.entry())
 		}
-		m.add(key, cacheVal.value, cacheVal.expired, cacheVal.deleted)
 	}
+	m.Ranges = c.ranges.list(time.Now().UnixNano())
 	return m
 
 }
 
+// digestMessage returns message which only contains
+// the digest of this cache
+func (c *cache) digestMessage(numBuckets int) *message {
+	m := c.newMessage(0)
+	m.Digest = c.digest(numBuckets)
+	m.Ranges = c.ranges.list(time.Now().UnixNano())
+	return m
+}
+
+// digest returns hash of every bucket of the cache entries.
+//
+// The shards keep the hash of their buckets up to date on every change,
+// so it doesn't need to hash the entries, unless the number of the buckets
+// is different from the configured one.
+// Expired and deleted entries are included until they are removed,
+// the buckets which have them could be different between peers for a while,
+// because they are removed lazily.
+func (c *cache) digest(numBuckets int) []uint64 {
+	digest := make([]uint64, numBuckets)
+	if numBuckets != len(c.shards[0].digest) {
+		for _, sh := range c.shards {
+			for _, key := range sh.keys() {
+				if val, ok := c.peek(key); ok {
+					digest[bucketOf(key, numBuckets)] ^= entryHash(key, val.entry())
+				}
+			}
+		}
+		return digest
+	}
+
+	for _, sh := range c.shards {
+		sh.digestInto(digest)
+	}
+	return digest
+}
+
+// bucketEntries returns the entries of the given buckets
+func (c *cache) bucketEntries(buckets []uint32, numBuckets int) map[string]entry {
+	wanted := make(map[uint32]struct{}, len(buckets))
+	for _, b := range buckets {
+		wanted[b] = struct{}{}
+	}
+
+	entries := make(map[string]entry)
+	c.forEachLive(func(key string, val *value) {
+		if _, ok := wanted[bucketOf(key, numBuckets)]; ok {
+			entries[key] = val.entry()
+		}
+	})
+	return entries
+}
+
+// originEntries returns the entries which last changed by the given peer,
+// including the deleted ones
+func (c *cache) originEntries(origin mesh.PeerName) map[string]entry {
+	entries := make(map[string]entry)
+	c.forEachLive(func(key string, val *value) {
+		if val.version.Origin == origin {
+			entries[key] = val.entry()
+		}
+	})
+	return entries
+}
+
+// forEachLive calls fn for every value which is not expired nor deleted
+func (c *cache) forEachLive(fn func(key string, val *value)) {
+	now := time.Now().UnixNano()
+	for _, sh := range c.shards {
+		for _, key := range sh.keys() {
+			val, ok := c.peek(key)
+			if !ok || val.removable(now) {
+				continue
+			}
+			fn(key, val)
+		}
+	}
+}
+
 // merges received data into state and returns a
 // representation of the received data (typically a delta) for further
 // propagation.
@@ -112,50 +435,137 @@ func (c *cache) mergeDelta(msg *message) (delta mesh.GossipData) {
 func (c *cache) mergeNew(msg *message) (delta mesh.GossipData) {
 	var changedKey int
 	delta, changedKey = c.mergeChange(msg)
-	if changedKey == 0 {
+	if changedKey == 0 && (delta == nil || len(delta.(*message).Ranges) == 0) {
 		return nil
 	}
 	return delta
 }
 
 func (c *cache) mergeChange(msg *message) (delta mesh.GossipData, changedKey int) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-
-	if len(msg.Entries) == 0 {
+	ranges := c.mergeRanges(msg)
+	if len(msg.Entries) == 0 && len(ranges) == 0 {
 		return
 	}
 
-	var existingKeys []string
-	for key, e := range msg.Entries {
-		cacheVal, ok := c.get(key)
-		if ok && cacheVal.expired >= e.Expired && cacheVal.deleted == e.Deleted {
-			// no changes:
-			// - key already exists
-			// - has bigger expiration value
-			// - has same deleted val
-			existingKeys = append(existingKeys, key)
+	var (
+		existingKeys []string
+		updated      []string
+	)
+	for i, keys := range c.shardKeys(msg.Entries) {
+		if len(keys) == 0 {
 			continue
 		}
-		c.Set(key, e.Val, e.Expired, e.Deleted)
-		changedKey++
+
+		sh := c.shards[i]
+		sh.mux.Lock()
+		for _, key := range keys {
+			merged, changed := c.merge(key, msg.Entries[key])
+			if !changed {
+				// no changes:
+				// - key already exists and has same or newer version
+				// - metadata only entry of unknown value
+				existingKeys = append(existingKeys, key)
+				continue
+			}
+			c.Set(key, merged)
+			updated = append(updated, key)
+			changedKey++
+		}
+		sh.mux.Unlock()
 	}
+	c.remoteUpdated(msg, updated)
 
 	// delete key that already existed in this cache
 	for _, key := range existingKeys {
 		delete(msg.Entries, key)
 	}
 
-	return newMessageFromEntries(c.peerID, msg.Entries), changedKey
+	c.metrics.Merged(changedKey)
+
+	m := newMessageFromEntries(c.peerID, msg.Entries)
+	m.Ranges = ranges
+	m.opts = c.wireOpts
+	m.metrics = c.metrics
+	m.stats = &c.stats
+	return m, changedKey
 }
 
 func (c *cache) mergeComplete(msg *message) {
-	for key, ent := range msg.Entries {
-		cacheVal, ok := c.get(key)
-		if !ok || cacheVal.expired < ent.Expired {
+	c.mergeRanges(msg)
+
+	var updated []string
+	for i, keys := range c.shardKeys(msg.Entries) {
+		if len(keys) == 0 {
+			continue
+		}
+
+		sh := c.shards[i]
+		sh.mux.Lock()
+		for _, key := range keys {
 			// if !exist in cache, set it
 			// if val in cache is older, set it
-			c.Set(key, ent.Val, ent.Expired, ent.Deleted)
+			if merged, changed := c.merge(key, msg.Entries[key]); changed {
+				c.Set(key, merged)
+				updated = append(updated, key)
+			}
+		}
+		sh.mux.Unlock()
+	}
+	c.remoteUpdated(msg, updated)
+	c.metrics.Merged(len(updated))
+}
+
+// remoteUpdated calls the remote update callback and notifies the watchers
+// of the given keys of the received message
+func (c *cache) remoteUpdated(msg *message, keys []string) {
+	for _, key := range keys {
+		e := msg.Entries[key]
+
+		// older peers don't send the version,
+		// the sender is the best guess of the origin
+		origin := e.Version.Origin
+		if origin == 0 {
+			origin = msg.PeerID
+		}
+
+		if c.onRemoteUpdate != nil {
+			c.onRemoteUpdate(key, uint64(origin))
 		}
+		if !e.MetaOnly {
+			c.notify(key, e, origin)
+		}
+	}
+}
+
+// notify sends the event of the given changed entry to the watchers
+func (c *cache) notify(key string, e entry, origin mesh.PeerName) {
+	ev := Event{
+		Type:   EventSet,
+		Key:    key,
+		Value:  e.Val,
+		Origin: uint64(origin),
+	}
+	if e.Deleted > 0 {
+		ev.Type = EventDelete
+		ev.Value = nil
+	}
+	c.watch.publish(ev)
+}
+
+// merge merges the given entry with the existing value of the key.
+// It returns the merged entry and true if it is different with the existing value.
+func (c *cache) merge(key string, e entry) (entry, bool) {
+	// received data is not an access of the key, it is read without
+	// recording the access, and the store doesn't promote the replaced key
+	if c.ranges.covers(key, e.Version, time.Now().UnixNano()) {
+		// deleted by the newer range tombstone
+		return e, false
+	}
+
+	cacheVal, ok := c.peek(key)
+	if !ok {
+		// metadata only entry couldn't be applied without the value
+		return e, !e.MetaOnly
 	}
+	return cacheVal.entry().merge(e)
 }
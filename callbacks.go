@@ -0,0 +1,92 @@
+package bcache
+
+import (
+	"sync"
+)
+
+// callbackQueue calls the queued callbacks by its own goroutine, in the order they are queued.
+//
+// The eviction and expiration happen while this peer is making a change,
+// calling the user callbacks from the queue lets them use the cache
+// without blocking the change which triggered them.
+type callbackQueue struct {
+	mux     sync.Mutex
+	queue   []func()
+	stopped bool
+
+	notifyCh chan struct{}
+	quitCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func newCallbackQueue() *callbackQueue {
+	return &callbackQueue{
+		notifyCh: make(chan struct{}, 1),
+		quitCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// start runs the queue in the background, until stopped
+func (q *callbackQueue) start() {
+	go q.loop()
+}
+
+// push queues the given callback, it never blocks.
+// The callbacks queued after the queue is stopped are dropped.
+func (q *callbackQueue) push(f func()) {
+	q.mux.Lock()
+	if q.stopped {
+		q.mux.Unlock()
+		return
+	}
+	q.queue = append(q.queue, f)
+	q.mux.Unlock()
+
+	select {
+	case q.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (q *callbackQueue) loop() {
+	defer close(q.doneCh)
+
+	for {
+		select {
+		case <-q.notifyCh:
+			q.run()
+		case <-q.quitCh:
+			// call the callbacks queued before the stop
+			q.run()
+			return
+		}
+	}
+}
+
+// run calls all of the queued callbacks
+func (q *callbackQueue) run() {
+	for {
+		q.mux.Lock()
+		queue := q.queue
+		q.queue = nil
+		q.mux.Unlock()
+
+		if len(queue) == 0 {
+			return
+		}
+		for _, f := range queue {
+			f()
+		}
+	}
+}
+
+// stop stops the queue and waits for the queued callbacks to be called
+func (q *callbackQueue) stop() {
+	q.mux.Lock()
+	q.stopped = true
+	q.mux.Unlock()
+
+	close(q.quitCh)
+	<-q.doneCh
+}
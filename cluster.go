@@ -0,0 +1,128 @@
+package bcache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// PeerState is the connection state of a peer in the cluster
+type PeerState int
+
+const (
+	// PeerConnected means this peer has an established connection to the peer
+	PeerConnected PeerState = iota + 1
+
+	// PeerConnecting means this peer has a connection to the peer,
+	// but it is not fully established yet
+	PeerConnecting
+
+	// PeerReachable means the peer is not connected directly,
+	// but reachable through the other peers
+	PeerReachable
+
+	// PeerUnreachable means the peer is known, but there is no route to it
+	PeerUnreachable
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerConnected:
+		return "connected"
+	case PeerConnecting:
+		return "connecting"
+	case PeerReachable:
+		return "reachable"
+	case PeerUnreachable:
+		return "unreachable"
+	}
+	return "unknown"
+}
+
+// PeerInfo is the information of a peer in the cluster, as seen by this peer
+type PeerInfo struct {
+	// ID is the PeerID of the peer
+	ID uint64
+
+	// Name is the name of the peer in the mesh network,
+	// which is the PeerID in MAC address format
+	Name string
+
+	// NickName is the nick name of the peer, which is its ListenAddr
+	NickName string
+
+	// Address is the remote address of the connection to the peer,
+	// it is empty if the peer is not connected directly
+	Address string
+
+	State PeerState
+
+	// LastSeen is the last time a gossip message received from the peer,
+	// it is zero if there is none yet
+	LastSeen time.Time
+}
+
+// Peers returns the other peers in the cluster known by this peer, sorted by ID.
+//
+// A peer is known once it has connected to any peer of the cluster,
+// and forgotten some time after it becomes unreachable.
+func (b *Bcache) Peers() []PeerInfo {
+	status := mesh.NewStatus(b.router)
+
+	// our connections and routes
+	var (
+		conns  = make(map[string]PeerInfo)
+		routes = make(map[string]struct{}, len(status.UnicastRoutes))
+	)
+	for _, ps := range status.Peers {
+		if ps.Name != status.Name {
+			continue
+		}
+		for _, conn := range ps.Connections {
+			state := PeerConnecting
+			if conn.Established {
+				state = PeerConnected
+			}
+			conns[conn.Name] = PeerInfo{
+				Address: conn.Address,
+				State:   state,
+			}
+		}
+	}
+	for _, route := range status.UnicastRoutes {
+		routes[route.Dest] = struct{}{}
+	}
+
+	infos := make([]PeerInfo, 0, len(status.Peers))
+	for _, ps := range status.Peers {
+		if ps.Name == status.Name {
+			continue
+		}
+
+		name, err := mesh.PeerNameFromString(ps.Name)
+		if err != nil {
+			b.logger.Errorf("invalid peer name %v: %v", ps.Name, err)
+			continue
+		}
+
+		info, ok := conns[ps.Name]
+		if !ok {
+			info.State = PeerUnreachable
+			if _, ok := routes[ps.Name]; ok {
+				info.State = PeerReachable
+			}
+		}
+		info.ID = uint64(name)
+		info.Name = ps.Name
+		info.NickName = ps.NickName
+		info.LastSeen = b.peer.lastSeenAt(name)
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
@@ -1,9 +1,40 @@
 package bcache
 
-import "github.com/weaveworks/mesh"
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/weaveworks/mesh"
+)
 
 const (
 	defaultDeletionDelay = 100 // default deletion delay : 100 seconds
+	defaultMaxClockDrift = 60  // default max clock drift : 60 seconds
+)
+
+var (
+	errEmptyPasswordFile = errors.New("empty password file")
+)
+
+// EvictionPolicy defines which key to evict when the cache is full
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used key
+	EvictLRU EvictionPolicy = "lru"
+
+	// EvictTwoQueue uses the 2Q policy, which separates the keys used once
+	// from the keys used more than once, so a scan doesn't evict the frequently used keys
+	EvictTwoQueue EvictionPolicy = "2q"
+
+	// EvictARC uses the Adaptive Replacement Cache policy, which is like 2Q
+	// but adapts the size of the lists to the workload
+	EvictARC EvictionPolicy = "arc"
+
+	// EvictTinyLFU uses the W-TinyLFU policy, which only admits a new key
+	// if it is used more frequently than the key it replaces
+	EvictTinyLFU EvictionPolicy = "tinylfu"
 )
 
 // Config represents bcache configuration
@@ -21,18 +52,151 @@ type Config struct {
 	// gossip protocol will find the other peers
 	Peers []string
 
+	// PeerProvider provides the addresses of the peers, e.g.: from DNS,
+	// it is polled every PeerProviderInterval to apply the changes.
+	// The peers could also be changed using Bcache.AddPeers and Bcache.ForgetPeer.
+	// Leave it nil to only use the Peers.
+	PeerProvider PeerProvider
+
+	// PeerProviderInterval defines interval in seconds of polling the PeerProvider.
+	// Leave it to 0 make it use default value: 30 seconds.
+	PeerProviderInterval int
+
+	// Password enables authentication and encryption of the connections between peers.
+	// All of the peers must use the same password, the connection
+	// from a peer with different password or without password is rejected.
+	// Leave it empty to disable it.
+	Password string
+
+	// PasswordFile is path of the file which contains the Password,
+	// the trailing whitespace is ignored.
+	// It is only used if the Password is empty.
+	PasswordFile string
+
 	// MaxKeys defines max number of keys in this cache
 	MaxKeys int
 
+	// MaxBytes defines max total size in bytes of the keys and values in this cache.
+	// The keys chosen by the EvictionPolicy of every shard are evicted in turn
+	// until the cache fits this size.
+	// A single key and value which is bigger than MaxBytes is not cached.
+	// It works alongside MaxKeys, MaxKeys could be left to 0 to only limit the size in bytes.
+	// The size doesn't include the bookkeeping overhead of the cache,
+	// so the actual memory usage is a bit bigger.
+	// Leave it to 0 to make the size unlimited.
+	MaxBytes int64
+
+	// EvictionPolicy defines which key to evict when the cache is full.
+	// Leave it empty to use the default policy: EvictLRU.
+	EvictionPolicy EvictionPolicy
+
+	// ShardCount defines number of the shards of this cache.
+	// Every shard has its own store and lock, more shards means less lock
+	// contention between concurrent access.
+	// MaxKeys is divided evenly between the shards, and the keys are evicted
+	// per shard, so a shard could evict its keys while the others still have room.
+	// The keys are not spread evenly, so the cache could hold noticeably less keys
+	// than MaxKeys, e.g. 16 shards of 100 keys in total usually hold around 94 keys.
+	// MaxBytes is shared by all of the shards.
+	// Leave it to 0 make it use default value: 1, which doesn't shard the cache.
+	ShardCount int
+
 	// Logger to be used
 	// leave it nil to use default logger which do nothing
 	Logger Logger
 
+	// Metrics collects the metrics of the cache and the gossip.
+	// PrometheusMetrics could be used to expose them to Prometheus.
+	// Leave it nil to not collect the metrics.
+	Metrics Metrics
+
 	// DeletionDelay adds delay before actually delete the key,
 	// it is used to handle temporary network connection issue,
 	// which could prevent data syncing between nodes.
 	// Leave it to 0 make it use default value: 100 seconds.
 	DeletionDelay int
+
+	// MaxClockDrift defines max difference in seconds of the clock of the other peers
+	// ahead of our clock. The changes received from a peer whose clock is further ahead
+	// are dropped until our clock catches up, and it is logged.
+	// Note that the concurrent changes are ordered by the clock of their peers,
+	// so the peer whose clock runs ahead wins them.
+	// Leave it to 0 make it use default value: 60 seconds.
+	MaxClockDrift int
+
+	// JanitorInterval defines interval in seconds of the background janitor,
+	// which removes the expired values and the tombstones of the deleted keys
+	// that are past the DeletionDelay.
+	// Without it, they are only removed when they are read or evicted.
+	// Leave it to 0 make it use default value: 60 seconds.
+	JanitorInterval int
+
+	// JanitorMaxKeys defines max number of keys examined by a janitor run,
+	// to limit the work done at once. The remaining keys are examined by the next runs.
+	// Leave it to 0 make it use default value: 10000 keys.
+	JanitorMaxKeys int
+
+	// LegacyEncoding makes this peer encode the gossip messages
+	// using the old JSON format.
+	// Enable it while upgrading a cluster from bcache version which
+	// only understand JSON, and disable it once all the peers have been upgraded.
+	// The peers always able to decode both formats.
+	LegacyEncoding bool
+
+	// GossipChunkKeys defines max number of keys in a single gossip message.
+	// Bigger gossip data, e.g.: the periodic full state gossip, will be split
+	// into multiple messages.
+	// Leave it to 0 make it use default value: 1000 keys.
+	GossipChunkKeys int
+
+	// GossipChunkBytes defines max size in bytes of a single gossip message.
+	// A single key which is bigger than this value will be sent in it's own message.
+	// Leave it to 0 make it use default value: 1 MB.
+	GossipChunkBytes int
+
+	// AntiEntropy makes the periodic gossip only send hash of the key ranges
+	// instead of all of the keys.
+	// The keys are only sent for the key ranges which are different between peers.
+	// All of the peers need to support it, and it is ignored when LegacyEncoding is enabled.
+	AntiEntropy bool
+
+	// AntiEntropyBuckets defines number of the key ranges used by the anti entropy.
+	// Leave it to 0 make it use default value: 256.
+	AntiEntropyBuckets int
+
+	// OnEvict is called when a key is evicted because the cache is full.
+	// OnEvict and OnExpire are called sequentially by a background goroutine,
+	// after the change which triggered them, so they could use the cache,
+	// but they must not call Close. The value must not be modified.
+	OnEvict func(key string, val []byte)
+
+	// OnExpire is called when an expired key is removed from the cache,
+	// which happens when it is read or by the janitor.
+	// It is called like OnEvict. The value must not be modified.
+	OnExpire func(key string, val []byte)
+
+	// OnRemoteUpdate is called when a change made by the other peer
+	// is applied to this cache, including the deletion of the key.
+	// origin is the PeerID of the peer which made the change.
+	// It is called synchronously by the gossip receiver, so it must be fast.
+	OnRemoteUpdate func(key string, origin uint64)
+
+	// OnPeerJoin is called when a peer joins the cluster,
+	// i.e.: it becomes reachable from this peer.
+	// The full state is exchanged with the newly connected peer by the gossip,
+	// there is no need to push it from this callback.
+	OnPeerJoin func(peerID uint64)
+
+	// OnPeerLeave is called when a peer leaves the cluster,
+	// i.e.: it is no longer reachable from this peer, which could also be caused by network partition.
+	// OnPeerJoin and OnPeerLeave are called sequentially by a background goroutine,
+	// which is waited by Close, so they must not call Close.
+	OnPeerLeave func(peerID uint64)
+
+	// WatchBufferSize defines number of the events buffered for every watcher.
+	// The new events are dropped when the buffer of a slow watcher is full.
+	// Leave it to 0 make it use default value: 256.
+	WatchBufferSize int
 }
 
 func (c *Config) setDefault() error {
@@ -55,10 +219,79 @@ func (c *Config) setDefault() error {
 		c.DeletionDelay = defaultDeletionDelay
 	}
 
+	if c.MaxClockDrift <= 0 {
+		c.MaxClockDrift = defaultMaxClockDrift
+	}
+
+	if c.PeerProviderInterval <= 0 {
+		c.PeerProviderInterval = defaultPeerProviderInterval
+	}
+
+	if c.JanitorInterval <= 0 {
+		c.JanitorInterval = defaultJanitorInterval
+	}
+
+	if c.JanitorMaxKeys <= 0 {
+		c.JanitorMaxKeys = defaultJanitorMaxKeys
+	}
+
+	if c.GossipChunkKeys <= 0 {
+		c.GossipChunkKeys = defaultChunkKeys
+	}
+
+	if c.GossipChunkBytes <= 0 {
+		c.GossipChunkBytes = defaultChunkBytes
+	}
+
+	if c.ShardCount <= 0 {
+		c.ShardCount = defaultShardCount
+	}
+
+	if c.WatchBufferSize <= 0 {
+		c.WatchBufferSize = defaultWatchBufferSize
+	}
+
+	if c.AntiEntropyBuckets <= 0 {
+		c.AntiEntropyBuckets = defaultAntiEntropyBuckets
+	}
+
 	// if logger is nil, create default nopLogger
 	if c.Logger == nil {
 		c.Logger = &nopLogger{}
 	}
 
+	if c.Metrics == nil {
+		c.Metrics = &nopMetrics{}
+	}
+
 	return nil
 }
+
+// password returns the Password, or read it from the PasswordFile.
+// It returns nil if there is no password.
+func (c *Config) password() ([]byte, error) {
+	if c.Password != "" {
+		return []byte(c.Password), nil
+	}
+	if c.PasswordFile == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(c.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimRight(b, " \t\r\n")
+	if len(b) == 0 {
+		return nil, errEmptyPasswordFile
+	}
+	return b, nil
+}
+
+func (c *Config) wireOptions() wireOptions {
+	return wireOptions{
+		legacyJSON: c.LegacyEncoding,
+		chunkKeys:  c.GossipChunkKeys,
+		chunkBytes: c.GossipChunkBytes,
+	}
+}
@@ -1,6 +1,8 @@
 package bcache
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -34,3 +36,54 @@ func TestConfig(t *testing.T) {
 	require.Equal(t, uint64(2), cfgManual.PeerID)
 	require.IsType(t, &logrus.Logger{}, cfgManual.Logger)
 }
+
+func TestConfigPassword(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	testCases := []struct {
+		name     string
+		cfg      Config
+		password []byte
+		err      bool
+	}{
+		{
+			name: "no password",
+		},
+		{
+			name:     "password",
+			cfg:      Config{Password: "secret", PasswordFile: "not-used"},
+			password: []byte("secret"),
+		},
+		{
+			name:     "password file",
+			cfg:      Config{PasswordFile: writeFile("password", "secret\n")},
+			password: []byte("secret"),
+		},
+		{
+			name: "empty password file",
+			cfg:  Config{PasswordFile: writeFile("empty", " \n")},
+			err:  true,
+		},
+		{
+			name: "password file not exists",
+			cfg:  Config{PasswordFile: filepath.Join(dir, "not-exists")},
+			err:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			password, err := tc.cfg.password()
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.password, password)
+		})
+	}
+}
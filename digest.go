@@ -0,0 +1,55 @@
+package bcache
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+const (
+	defaultAntiEntropyBuckets = 256
+)
+
+// digestBuckets returns number of the anti entropy buckets of the given config,
+// it returns 0 if the anti entropy is disabled.
+func digestBuckets(cfg Config) int {
+	if !cfg.AntiEntropy || cfg.LegacyEncoding {
+		return 0
+	}
+	if cfg.AntiEntropyBuckets <= 0 {
+		return defaultAntiEntropyBuckets
+	}
+	return cfg.AntiEntropyBuckets
+}
+
+// bucketOf returns the anti entropy bucket of the given key
+func bucketOf(key string, numBuckets int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % uint32(numBuckets)
+}
+
+// entryHash returns hash of the given key and entry
+func entryHash(key string, e entry) uint64 {
+	var buf [4 * binary.MaxVarintLen64]byte
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write(e.Val)
+	n := binary.PutVarint(buf[:], e.Expired)
+	n += binary.PutVarint(buf[n:], e.Deleted)
+	n += binary.PutUvarint(buf[n:], e.Version.Clock)
+	n += binary.PutUvarint(buf[n:], uint64(e.Version.Origin))
+	h.Write(buf[:n])
+	return h.Sum64()
+}
+
+// diffBuckets returns index of the buckets which have different hash
+func diffBuckets(digest, other []uint64) []uint32 {
+	var buckets []uint32
+	for i, h := range digest {
+		if i >= len(other) || other[i] != h {
+			buckets = append(buckets, uint32(i))
+		}
+	}
+	return buckets
+}
@@ -0,0 +1,116 @@
+package bcache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestBucketOf(t *testing.T) {
+	const numBuckets = 16
+
+	for _, key := range []string{"", "key1", "key2", "a very long key"} {
+		b := bucketOf(key, numBuckets)
+		require.True(t, b < numBuckets)
+		require.Equal(t, b, bucketOf(key, numBuckets))
+	}
+}
+
+func TestEntryHash(t *testing.T) {
+	e := entry{
+		Val:     []byte("val"),
+		Expired: 10,
+	}
+	require.Equal(t, entryHash("key", e), entryHash("key", e))
+
+	testCases := []struct {
+		name  string
+		key   string
+		entry entry
+	}{
+		{
+			name:  "diff key",
+			key:   "key2",
+			entry: e,
+		},
+		{
+			name:  "diff val",
+			key:   "key",
+			entry: entry{Val: []byte("val2"), Expired: 10},
+		},
+		{
+			name:  "diff expired",
+			key:   "key",
+			entry: entry{Val: []byte("val"), Expired: 11},
+		},
+		{
+			name:  "deleted",
+			key:   "key",
+			entry: entry{Val: []byte("val"), Expired: 10, Deleted: 5},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NotEqual(t, entryHash("key", e), entryHash(tc.key, tc.entry))
+		})
+	}
+}
+
+func TestDiffBuckets(t *testing.T) {
+	require.Nil(t, diffBuckets([]uint64{1, 2, 3}, []uint64{1, 2, 3}))
+	require.Equal(t, []uint32{1}, diffBuckets([]uint64{1, 2, 3}, []uint64{1, 5, 3}))
+	require.Equal(t, []uint32{0, 2}, diffBuckets([]uint64{1, 2, 3}, []uint64{0, 2}))
+}
+
+// digest kept by the shards is the same as the digest of all of the entries
+func TestCacheDigest(t *testing.T) {
+	const numBuckets = 16
+
+	cc, err := newCache(mesh.PeerName(1), Config{
+		MaxKeys:            50,
+		ShardCount:         4,
+		AntiEntropy:        true,
+		AntiEntropyBuckets: numBuckets,
+	})
+	require.NoError(t, err)
+
+	keys := func() []string {
+		var keys []string
+		for _, sh := range cc.shards {
+			keys = append(keys, sh.keys()...)
+		}
+		return keys
+	}
+	fullDigest := func(numBuckets int) []uint64 {
+		digest := make([]uint64, numBuckets)
+		for _, key := range keys() {
+			val, ok := cc.peek(key)
+			require.True(t, ok)
+			digest[bucketOf(key, numBuckets)] ^= entryHash(key, val.entry())
+		}
+		return digest
+	}
+
+	expired := time.Now().Add(time.Hour).UnixNano()
+	for i := 0; i < 100; i++ {
+		cc.Set(strconv.Itoa(i), entry{Val: []byte("val"), Expired: expired})
+	}
+	require.Equal(t, fullDigest(numBuckets), cc.digest(numBuckets))
+
+	// replaced, deleted, and expired
+	cached := keys()
+	cc.Set(cached[0], entry{Val: []byte("new"), Expired: expired})
+	cc.Delete(cached[1], time.Now().Add(time.Hour).UnixNano(), version{})
+	cc.Set(cached[2], entry{Val: []byte("val"), Expired: time.Now().Add(-time.Second).UnixNano()})
+	require.Equal(t, fullDigest(numBuckets), cc.digest(numBuckets))
+	_, ok := cc.Get(cached[2])
+	require.False(t, ok)
+	require.Equal(t, fullDigest(numBuckets), cc.digest(numBuckets))
+
+	// other number of buckets
+	require.Equal(t, fullDigest(8), cc.digest(8))
+}
@@ -0,0 +1,169 @@
+package bcache
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPeerProviderInterval = 30 // default interval of polling the PeerProvider: 30 seconds
+)
+
+// PeerProvider provides the addresses of the peers in host:port format,
+// e.g.: from DNS, file, or service discovery.
+//
+// It is polled periodically, the new addresses are connected
+// and the addresses which are no longer provided are forgotten.
+type PeerProvider interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// PeerProviderFunc is an adapter to use a func as PeerProvider
+type PeerProviderFunc func(ctx context.Context) ([]string, error)
+
+// Peers implements PeerProvider.Peers
+func (f PeerProviderFunc) Peers(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// DNSPeers is PeerProvider which resolves the addresses of the peers from DNS,
+// e.g.: a headless service of Kubernetes.
+type DNSPeers struct {
+	// Host is the DNS name to be resolved
+	Host string
+
+	// Port is the port of the peers, the same for all of them
+	Port int
+}
+
+// Peers implements PeerProvider.Peers
+func (d DNSPeers) Peers(ctx context.Context) ([]string, error) {
+	ips, err := net.DefaultResolver.LookupHost(ctx, d.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	port := strconv.Itoa(d.Port)
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs, nil
+}
+
+// peerConnector connects to the peers,
+// it is implemented by the ConnectionMaker of mesh.Router
+type peerConnector interface {
+	InitiateConnections(peers []string, replace bool) []error
+	ForgetConnections(peers []string)
+}
+
+// discovery periodically polls the PeerProvider,
+// and connects to the provided peers
+type discovery struct {
+	provider  PeerProvider
+	connector peerConnector
+	interval  time.Duration
+	logger    Logger
+
+	peers  map[string]struct{} // the last provided peers
+	quitCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newDiscovery(provider PeerProvider, connector peerConnector, interval time.Duration, logger Logger) *discovery {
+	return &discovery{
+		provider:  provider,
+		connector: connector,
+		interval:  interval,
+		logger:    logger,
+		peers:     make(map[string]struct{}),
+		quitCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+}
+
+// start runs the discovery in the background, until stopped
+func (d *discovery) start() {
+	go d.loop()
+}
+
+func (d *discovery) loop() {
+	defer close(d.doneCh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-d.quitCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.poll(ctx); err != nil {
+			d.logger.Errorf("failed to get the peers from the provider: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.quitCh:
+			return
+		}
+	}
+}
+
+// stop stops the discovery and waits for the running poll to be finished
+func (d *discovery) stop() {
+	close(d.quitCh)
+	<-d.doneCh
+}
+
+// poll gets the peers from the provider, connects to the new peers
+// and forgets the peers which are no longer provided.
+// The peers are kept as they are if the provider returns error.
+func (d *discovery) poll(ctx context.Context) error {
+	addrs, err := d.provider.Peers(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		peers = make(map[string]struct{}, len(addrs))
+		added []string
+	)
+	for _, addr := range addrs {
+		peers[addr] = struct{}{}
+		if _, ok := d.peers[addr]; !ok {
+			added = append(added, addr)
+		}
+	}
+
+	var removed []string
+	for addr := range d.peers {
+		if _, ok := peers[addr]; !ok {
+			removed = append(removed, addr)
+		}
+	}
+
+	if len(removed) > 0 {
+		d.logger.Printf("forget peers: %v", removed)
+		d.connector.ForgetConnections(removed)
+	}
+	if len(added) > 0 {
+		d.logger.Printf("add peers: %v", added)
+		for _, err := range d.connector.InitiateConnections(added, false) {
+			d.logger.Errorf("failed to add peer: %v", err)
+		}
+	}
+
+	d.peers = peers
+	return nil
+}
@@ -0,0 +1,136 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConnector records the peers connected by the discovery
+type fakeConnector struct {
+	mux   sync.Mutex
+	peers map[string]struct{}
+}
+
+func newFakeConnector() *fakeConnector {
+	return &fakeConnector{
+		peers: make(map[string]struct{}),
+	}
+}
+
+func (fc *fakeConnector) InitiateConnections(peers []string, replace bool) []error {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	for _, peer := range peers {
+		fc.peers[peer] = struct{}{}
+	}
+	return nil
+}
+
+func (fc *fakeConnector) ForgetConnections(peers []string) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	for _, peer := range peers {
+		delete(fc.peers, peer)
+	}
+}
+
+func (fc *fakeConnector) targets() []string {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	var peers []string
+	for peer := range fc.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func TestDiscoveryPoll(t *testing.T) {
+	var (
+		provided  []string
+		errFailed = errors.New("failed")
+		err       error
+		connector = newFakeConnector()
+	)
+	provider := PeerProviderFunc(func(ctx context.Context) ([]string, error) {
+		return provided, err
+	})
+	d := newDiscovery(provider, connector, time.Second, &nopLogger{})
+
+	// peer which is not managed by the provider
+	connector.InitiateConnections([]string{"10.0.0.1:1000"}, false)
+
+	testCases := []struct {
+		name     string
+		provided []string
+		err      error
+		targets  []string
+	}{
+		{
+			name:     "add",
+			provided: []string{"10.0.0.2:1000", "10.0.0.3:1000"},
+			targets:  []string{"10.0.0.1:1000", "10.0.0.2:1000", "10.0.0.3:1000"},
+		},
+		{
+			name:     "add and forget",
+			provided: []string{"10.0.0.3:1000", "10.0.0.4:1000"},
+			targets:  []string{"10.0.0.1:1000", "10.0.0.3:1000", "10.0.0.4:1000"},
+		},
+		{
+			name:    "error keeps the peers",
+			err:     errFailed,
+			targets: []string{"10.0.0.1:1000", "10.0.0.3:1000", "10.0.0.4:1000"},
+		},
+		{
+			name:    "forget all",
+			targets: []string{"10.0.0.1:1000"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provided, err = tc.provided, tc.err
+
+			require.Equal(t, tc.err, d.poll(context.Background()))
+			require.ElementsMatch(t, tc.targets, connector.targets())
+		})
+	}
+}
+
+func TestDiscoveryLoop(t *testing.T) {
+	var (
+		connector = newFakeConnector()
+		ctxErr    = make(chan error, 1)
+	)
+	provider := PeerProviderFunc(func(ctx context.Context) ([]string, error) {
+		go func() {
+			<-ctx.Done()
+			ctxErr <- ctx.Err()
+		}()
+		return []string{"10.0.0.1:1000"}, nil
+	})
+
+	// the first poll is not delayed by the interval
+	d := newDiscovery(provider, connector, time.Hour, &nopLogger{})
+	d.start()
+
+	require.Eventually(t, func() bool {
+		return len(connector.targets()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the context is canceled on stop
+	d.stop()
+	require.Equal(t, context.Canceled, <-ctxErr)
+}
+
+func TestDNSPeers(t *testing.T) {
+	peers, err := DNSPeers{Host: "localhost", Port: 12345}.Peers(context.Background())
+	require.NoError(t, err)
+	require.Contains(t, peers, "127.0.0.1:12345")
+}
@@ -0,0 +1,110 @@
+package bcache
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	// number of bits of the logical counter in the hlc timestamp
+	hlcLogicalBits = 16
+)
+
+// version is the version of an entry.
+// Conflicting changes are resolved by the version, the newer version wins.
+type version struct {
+	// Clock is hybrid logical clock timestamp of the change
+	Clock uint64
+
+	// Origin is the peer which made the change,
+	// it breaks the tie when two peers made the change at the same Clock
+	Origin mesh.PeerName
+}
+
+func (v version) isZero() bool {
+	return v.Clock == 0 && v.Origin == 0
+}
+
+// compare returns 1 if v is newer than other,
+// -1 if v is older than other, and 0 if both are equal
+func (v version) compare(other version) int {
+	switch {
+	case v.Clock > other.Clock:
+		return 1
+	case v.Clock < other.Clock:
+		return -1
+	case v.Origin > other.Origin:
+		return 1
+	case v.Origin < other.Origin:
+		return -1
+	}
+	return 0
+}
+
+// hlc is hybrid logical clock.
+//
+// The timestamp is the physical time in millisecond,
+// shifted to give room for the logical counter in the lower bits.
+// It never goes backward, even when the physical clock does, and it is always
+// bigger than every timestamp observed from the other peers, so the order of
+// the changes follows the causality.
+// The concurrent changes are still ordered by the physical clock of their hosts,
+// so the host whose clock runs ahead wins them.
+//
+// The observed timestamps which are ahead of our physical clock by more than maxDrift
+// are rejected, so a single host with bad clock couldn't move the clock of every host forward.
+// The changes carrying those timestamps must be rejected as well, otherwise they
+// would win every later change of this host.
+type hlc struct {
+	mux      sync.Mutex
+	last     uint64
+	now      func() time.Time
+	maxDrift time.Duration // 0 means unlimited
+}
+
+func newHLC(maxDrift time.Duration) *hlc {
+	return &hlc{
+		now:      time.Now,
+		maxDrift: maxDrift,
+	}
+}
+
+// Now returns new timestamp for a local change
+func (c *hlc) Now() uint64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	ts := uint64(c.now().UnixNano()/int64(time.Millisecond)) << hlcLogicalBits
+	if ts > c.last {
+		c.last = ts
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Update updates the clock with the timestamp observed from other peer.
+// It returns false if the timestamp is rejected because it is too far ahead.
+func (c *hlc) Update(ts uint64) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if ts > c.limit() {
+		return false
+	}
+	if ts > c.last {
+		c.last = ts
+	}
+	return true
+}
+
+// limit returns the biggest timestamp which could be observed from other peer
+func (c *hlc) limit() uint64 {
+	if c.maxDrift <= 0 {
+		return math.MaxUint64
+	}
+	return uint64(c.now().Add(c.maxDrift).UnixNano()/int64(time.Millisecond)) << hlcLogicalBits
+}
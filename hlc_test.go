@@ -0,0 +1,106 @@
+package bcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLC(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	c := newHLC(0)
+	c.now = func() time.Time { return now }
+
+	// monotonic within the same physical time
+	t1 := c.Now()
+	t2 := c.Now()
+	require.True(t, t2 > t1)
+
+	// physical clock goes backward
+	now = now.Add(-time.Minute)
+	t3 := c.Now()
+	require.True(t, t3 > t2)
+
+	// observe timestamp from peer with faster clock
+	remote := t3 + (uint64(time.Hour/time.Millisecond) << hlcLogicalBits)
+	c.Update(remote)
+	t4 := c.Now()
+	require.True(t, t4 > remote)
+
+	// older remote timestamp doesn't move the clock backward
+	c.Update(t1)
+	require.True(t, c.Now() > t4)
+
+	// physical clock catch up
+	now = now.Add(2 * time.Hour)
+	t5 := c.Now()
+	require.True(t, t5 > t4)
+	require.Equal(t, uint64(now.UnixNano()/int64(time.Millisecond))<<hlcLogicalBits, t5)
+}
+
+func TestHLCMaxDrift(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	c := newHLC(time.Minute)
+	c.now = func() time.Time { return now }
+	t1 := c.Now()
+
+	ahead := func(d time.Duration) uint64 {
+		return uint64(now.Add(d).UnixNano()/int64(time.Millisecond)) << hlcLogicalBits
+	}
+
+	// within the drift
+	require.True(t, c.Update(ahead(30*time.Second)))
+	t2 := c.Now()
+	require.True(t, t2 > ahead(30*time.Second))
+
+	// too far ahead doesn't move the clock
+	require.False(t, c.Update(ahead(time.Hour)))
+	t3 := c.Now()
+	require.True(t, t3 > t2)
+	require.True(t, t3 < ahead(time.Hour))
+	require.True(t, t1 < t3)
+}
+
+func TestVersionCompare(t *testing.T) {
+	testCases := []struct {
+		name  string
+		v     version
+		other version
+		want  int
+	}{
+		{
+			name:  "equal",
+			v:     version{Clock: 1, Origin: 1},
+			other: version{Clock: 1, Origin: 1},
+			want:  0,
+		},
+		{
+			name:  "newer clock",
+			v:     version{Clock: 2, Origin: 1},
+			other: version{Clock: 1, Origin: 2},
+			want:  1,
+		},
+		{
+			name:  "older clock",
+			v:     version{Clock: 1, Origin: 2},
+			other: version{Clock: 2, Origin: 1},
+			want:  -1,
+		},
+		{
+			name:  "same clock, bigger origin",
+			v:     version{Clock: 1, Origin: 2},
+			other: version{Clock: 1, Origin: 1},
+			want:  1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, tc.v.compare(tc.other))
+			require.Equal(t, -tc.want, tc.other.compare(tc.v))
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package bcache
+
+import (
+	"time"
+)
+
+const (
+	defaultJanitorInterval = 60    // default janitor interval: 60 seconds
+	defaultJanitorMaxKeys  = 10000 // default max keys examined per janitor run
+)
+
+// janitor periodically removes the expired values and the tombstones
+// of the deleted keys, which otherwise only removed when they are read.
+//
+// The tombstone is kept until its deletion timestamp, which already includes
+// the DeletionDelay, so it has been gossiped to the other peers before it is removed.
+type janitor struct {
+	cc       *cache
+	interval time.Duration
+	maxKeys  int
+	logger   Logger
+
+	next    int      // next shard to sweep
+	current int      // shard being swept
+	pending []string // keys of the shard being swept, not examined yet
+	quitCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+func newJanitor(cc *cache, interval time.Duration, maxKeys int, logger Logger) *janitor {
+	return &janitor{
+		cc:       cc,
+		interval: interval,
+		maxKeys:  maxKeys,
+		logger:   logger,
+		quitCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// start runs the janitor in the background, until stopped
+func (j *janitor) start() {
+	go j.loop()
+}
+
+func (j *janitor) loop() {
+	defer close(j.doneCh)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			removed := j.sweep(time.Now().UnixNano())
+			j.logger.Debugf("janitor removed %d keys", removed)
+		case <-j.quitCh:
+			return
+		}
+	}
+}
+
+// stop stops the janitor and waits for the running sweep to be finished
+func (j *janitor) stop() {
+	close(j.quitCh)
+	<-j.doneCh
+}
+
+// sweep removes the removable keys of the shards, continuing from
+// the key where the previous sweep stopped.
+// It stops once it examined maxKeys keys.
+//
+// The keys of a shard are listed once when its sweep starts,
+// and examined by as many runs as needed.
+// The keys added afterwards are examined by the next sweep of the shard.
+//
+// It returns number of the removed keys.
+func (j *janitor) sweep(now int64) int {
+	var (
+		shards   = j.cc.shards
+		examined int
+		removed  int
+		listed   int
+	)
+
+	for examined < j.maxKeys {
+		if len(j.pending) == 0 {
+			// every shard is listed at most once per run, they could be empty
+			if listed == len(shards) {
+				break
+			}
+			j.current = j.next
+			j.pending = shards[j.current].keys()
+			j.next = (j.next + 1) % len(shards)
+			listed++
+			continue
+		}
+
+		key := j.pending[0]
+		j.pending = j.pending[1:]
+		examined++
+
+		// lock per key, to not block the other access for the whole sweep
+		if shards[j.current].expire(key, now) {
+			removed++
+		}
+	}
+	if len(j.pending) == 0 {
+		j.pending = nil
+	}
+	return removed
+}
@@ -0,0 +1,75 @@
+package bcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestJanitorSweep(t *testing.T) {
+	cc, err := newCache(mesh.PeerName(1), Config{MaxKeys: 1000})
+	require.NoError(t, err)
+
+	var (
+		now    = time.Now().UnixNano()
+		future = now + int64(time.Hour)
+	)
+
+	cc.Set("live", entry{Val: []byte("val"), Expired: future + int64(time.Hour)})
+	cc.Set("expired", entry{Val: []byte("val"), Expired: now - 1})
+	cc.Set("deleted", entry{Val: []byte("val"), Expired: future, Deleted: now - 1})
+	// tombstone still within the deletion delay
+	cc.Set("deleting", entry{Val: []byte("val"), Expired: future, Deleted: future})
+
+	j := newJanitor(cc, time.Minute, 1000, &nopLogger{})
+	require.Equal(t, 2, j.sweep(now))
+	require.Equal(t, 2, cc.len())
+	require.Equal(t, int64(len("live")+len("deleting")+6), cc.usedBytes())
+
+	_, ok := cc.peek("deleting")
+	require.True(t, ok)
+
+	// tombstone past the deletion delay
+	require.Equal(t, 1, j.sweep(future))
+	_, ok = cc.peek("deleting")
+	require.False(t, ok)
+}
+
+func TestJanitorMaxKeys(t *testing.T) {
+	const numKeys = 1000
+
+	cc, err := newCache(mesh.PeerName(1), Config{MaxKeys: 2 * numKeys, ShardCount: 4})
+	require.NoError(t, err)
+
+	now := time.Now().UnixNano()
+	for i := 0; i < numKeys; i++ {
+		cc.Set(fmt.Sprintf("key-%d", i), entry{Expired: now - 1})
+	}
+
+	// every run only examines the max keys, continuing across the shards
+	j := newJanitor(cc, time.Minute, 300, &nopLogger{})
+	for _, remaining := range []int{700, 400, 100, 0} {
+		j.sweep(now)
+		require.Equal(t, remaining, cc.len())
+	}
+
+	// empty cache
+	require.Equal(t, 0, j.sweep(now))
+}
+
+func TestJanitorLoop(t *testing.T) {
+	cc, err := newCache(mesh.PeerName(1), Config{MaxKeys: 1000})
+	require.NoError(t, err)
+
+	j := newJanitor(cc, 10*time.Millisecond, 1000, &nopLogger{})
+	j.start()
+	defer j.stop()
+
+	cc.Set("key", entry{Val: []byte("val"), Expired: time.Now().Add(50 * time.Millisecond).UnixNano()})
+	require.Eventually(t, func() bool {
+		return cc.len() == 0
+	}, time.Second, 10*time.Millisecond)
+}
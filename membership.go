@@ -0,0 +1,102 @@
+package bcache
+
+import (
+	"github.com/weaveworks/mesh"
+)
+
+// membership tracks the peers which are reachable from this peer,
+// and calls the callbacks when a peer joins or leaves the cluster.
+//
+// The changes are detected on the topology changes of the mesh network,
+// the callbacks are called by its own goroutine, so they could use the cache
+// without blocking the mesh router.
+type membership struct {
+	reachable func() []mesh.PeerName
+	onJoin    func(peerID uint64)
+	onLeave   func(peerID uint64)
+
+	members  map[mesh.PeerName]struct{}
+	changeCh chan struct{}
+	quitCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func newMembership(reachable func() []mesh.PeerName, onJoin, onLeave func(peerID uint64)) *membership {
+	return &membership{
+		reachable: reachable,
+		onJoin:    onJoin,
+		onLeave:   onLeave,
+		members:   make(map[mesh.PeerName]struct{}),
+		changeCh:  make(chan struct{}, 1),
+		quitCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+}
+
+// reachablePeers returns the other peers which have route from this peer
+func reachablePeers(router *mesh.Router) []mesh.PeerName {
+	var names []mesh.PeerName
+	for _, desc := range router.Peers.Descriptions() {
+		if desc.Self {
+			continue
+		}
+		if _, ok := router.Routes.Unicast(desc.Name); ok {
+			names = append(names, desc.Name)
+		}
+	}
+	return names
+}
+
+// changed notifies the membership that the topology has changed.
+// It never blocks, the changes which happen during an update are coalesced.
+func (m *membership) changed() {
+	select {
+	case m.changeCh <- struct{}{}:
+	default:
+	}
+}
+
+// start runs the membership in the background, until stopped
+func (m *membership) start() {
+	go m.loop()
+}
+
+func (m *membership) loop() {
+	defer close(m.doneCh)
+
+	for {
+		select {
+		case <-m.changeCh:
+			m.update()
+		case <-m.quitCh:
+			return
+		}
+	}
+}
+
+// stop stops the membership and waits for the running callbacks to be finished
+func (m *membership) stop() {
+	close(m.quitCh)
+	<-m.doneCh
+}
+
+// update compares the reachable peers with the current members,
+// and calls the callbacks of the differences
+func (m *membership) update() {
+	current := make(map[mesh.PeerName]struct{}, len(m.members))
+	for _, name := range m.reachable() {
+		current[name] = struct{}{}
+	}
+
+	for name := range m.members {
+		if _, ok := current[name]; !ok && m.onLeave != nil {
+			m.onLeave(uint64(name))
+		}
+	}
+	for name := range current {
+		if _, ok := m.members[name]; !ok && m.onJoin != nil {
+			m.onJoin(uint64(name))
+		}
+	}
+	m.members = current
+}
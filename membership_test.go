@@ -0,0 +1,91 @@
+package bcache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestMembershipUpdate(t *testing.T) {
+	var (
+		reachable []mesh.PeerName
+		joined    []uint64
+		left      []uint64
+	)
+	m := newMembership(func() []mesh.PeerName {
+		return reachable
+	}, func(peerID uint64) {
+		joined = append(joined, peerID)
+	}, func(peerID uint64) {
+		left = append(left, peerID)
+	})
+
+	testCases := []struct {
+		name      string
+		reachable []mesh.PeerName
+		joined    []uint64
+		left      []uint64
+	}{
+		{
+			name:      "join",
+			reachable: []mesh.PeerName{2, 3},
+			joined:    []uint64{2, 3},
+		},
+		{
+			name:      "no change",
+			reachable: []mesh.PeerName{3, 2},
+		},
+		{
+			name:      "join and leave",
+			reachable: []mesh.PeerName{3, 4},
+			joined:    []uint64{4},
+			left:      []uint64{2},
+		},
+		{
+			name: "leave all",
+			left: []uint64{3, 4},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reachable, joined, left = tc.reachable, nil, nil
+
+			m.update()
+			require.ElementsMatch(t, tc.joined, joined)
+			require.ElementsMatch(t, tc.left, left)
+		})
+	}
+}
+
+func TestMembershipLoop(t *testing.T) {
+	var (
+		mux    sync.Mutex
+		joined []uint64
+	)
+	m := newMembership(func() []mesh.PeerName {
+		return []mesh.PeerName{2}
+	}, func(peerID uint64) {
+		mux.Lock()
+		joined = append(joined, peerID)
+		mux.Unlock()
+	}, nil)
+	m.start()
+
+	// coalesced changes
+	for i := 0; i < 10; i++ {
+		m.changed()
+	}
+
+	require.Eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(joined) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	m.stop()
+	m.changed() // must not block after stopped
+	require.Equal(t, []uint64{2}, joined)
+}
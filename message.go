@@ -12,18 +12,92 @@ const (
 )
 
 // message defines gossip message used for communication between peers
-// TODO: use protobuf for encoding
 type message struct {
 	mux     sync.RWMutex
 	PeerID  mesh.PeerName
 	Entries map[string]entry
+
+	// Digest is hash of every bucket of the sender's entries,
+	// used by the anti entropy mode
+	Digest []uint64
+
+	// Repair is the buckets which the receiver
+	// need to send back to the sender
+	Repair []uint32
+
+	// AckID is set if the sender wants the receiver to acknowledge
+	// that it has merged the entries, by sending back the AckID in Acks
+	AckID uint64
+	Acks  []uint64
+
+	// Ranges are the range tombstones,
+	// which delete the keys of the prefix made before them
+	Ranges []rangeTombstone
+
+	opts    wireOptions
+	metrics Metrics
+	stats   *cacheStats
 }
 
 // entry is a single key value entry
 type entry struct {
-	Val     string
+	Val     []byte
 	Expired int64
 	Deleted int64
+	Version version
+
+	// MetaOnly entry only updates the expiration timestamp,
+	// it doesn't carry the value.
+	// It could only be applied to the entry with Base version.
+	MetaOnly bool
+	Base     version
+}
+
+// replaces returns true if this entry should replace the existing one.
+//
+// The entry with newer version wins.
+// Entries from the peers which don't support versioning have zero version,
+// in this case the one which expires later wins.
+func (e entry) replaces(existing entry) bool {
+	if e.Version.isZero() || existing.Version.isZero() {
+		return e.Expired > existing.Expired ||
+			(e.Expired == existing.Expired && e.Deleted > existing.Deleted)
+	}
+	return e.Version.compare(existing.Version) > 0
+}
+
+// merge merges the other entry into this entry.
+// It returns the merged entry and true if this entry changed.
+func (e entry) merge(other entry) (entry, bool) {
+	switch {
+	case e.MetaOnly && other.MetaOnly && e.Base == other.Base:
+		// metadata changes of the same value, the newer one wins
+		if other.replaces(e) {
+			return other, true
+		}
+		return e, false
+
+	case other.MetaOnly:
+		// only apply the metadata to the value it was based on
+		if e.Version != other.Base || !other.replaces(e) {
+			return e, false
+		}
+		merged := e
+		merged.Expired = other.Expired
+		merged.Version = other.Version
+		return merged, true
+
+	case e.MetaOnly && other.Version == e.Base:
+		// the value which this metadata based on
+		merged := other
+		merged.Expired = e.Expired
+		merged.Version = e.Version
+		return merged, true
+
+	case other.replaces(e):
+		return other, true
+	}
+	return e, false
 }
 
 func newMessage(peerID mesh.PeerName, numEntries int) *message {
@@ -45,32 +119,107 @@ func newMessageFromEntries(peerID mesh.PeerName, entries map[string]entry) *mess
 }
 
 func newMessageFromBuf(b []byte) (*message, error) {
-	var m message
-	err := unmarshal(b, &m)
-	return &m, err
+	m, err := decodeMessage(b)
+	if err != nil {
+		return &message{}, err
+	}
+	return m, nil
 }
 
-func (m *message) add(key, val string, expired, deleted int64) {
+func (m *message) add(key string, e entry) {
 	m.mux.Lock()
-	m.Entries[key] = entry{
-		Val:     val,
-		Expired: expired,
-		Deleted: deleted,
-	}
+	m.Entries[key] = e
 	m.mux.Unlock()
 }
 
+// maxClock returns the biggest hlc timestamp of the entries and range tombstones
+func (m *message) maxClock() uint64 {
+	var clock uint64
+	for _, e := range m.Entries {
+		if e.Version.Clock > clock {
+			clock = e.Version.Clock
+		}
+	}
+	for _, r := range m.Ranges {
+		if r.Version.Clock > clock {
+			clock = r.Version.Clock
+		}
+	}
+	return clock
+}
+
+// dropNewer removes the entries and range tombstones whose version
+// is newer than the given clock, it returns the number of the removed ones
+func (m *message) dropNewer(clock uint64) int {
+	var n int
+	for k, e := range m.Entries {
+		if e.Version.Clock > clock {
+			delete(m.Entries, k)
+			n++
+		}
+	}
+
+	ranges := m.Ranges[:0]
+	for _, r := range m.Ranges {
+		if r.Version.Clock > clock {
+			n++
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	m.Ranges = ranges
+	return n
+}
+
 // Encode implements mesh.GossipData.Encode
-// TODO: split the encoding by X number of keys
+//
+// The entries are split into chunks bounded by number of keys and size,
+// each chunk is a complete message which could be merged on its own.
 func (m *message) Encode() [][]byte {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 
-	b, err := marshal(m)
-	if err != nil {
-		log.Printf("failed to encode message: %v", err)
+	chunks := m.opts.chunks(m.Entries)
+	bufs := make([][]byte, 0, len(chunks))
+
+	for i, entries := range chunks {
+		chunk := &message{
+			PeerID:  m.PeerID,
+			Entries: entries,
+		}
+		if i == 0 {
+			// anti entropy, acknowledgement and range tombstones only sent once.
+			// The range tombstones are merged before the entries,
+			// so they never delete the newer entries of the same chunk.
+			chunk.Digest = m.Digest
+			chunk.Repair = m.Repair
+			chunk.AckID = m.AckID
+			chunk.Acks = m.Acks
+			chunk.Ranges = m.Ranges
+		}
+
+		if !m.opts.legacyJSON {
+			bufs = append(bufs, encodeBinary(chunk))
+			continue
+		}
+
+		b, err := encodeJSON(chunk)
+		if err != nil {
+			log.Printf("failed to encode message: %v", err)
+			continue
+		}
+		bufs = append(bufs, b)
+	}
+
+	for _, b := range bufs {
+		if m.metrics != nil {
+			m.metrics.GossipSent(len(b))
+		}
+		if m.stats != nil {
+			m.stats.sent(len(b))
+		}
 	}
-	return [][]byte{b}
+	return bufs
 }
 
 // Merge implements mesh.GossipData.Merge
@@ -84,13 +233,27 @@ func (m *message) mergeComplete(other *message) mesh.GossipData {
 
 	for k, v := range other.Entries {
 		existing, ok := m.Entries[k]
-
-		// merge
-		// - the key not exists in
-		// - has less expiration time
-		if !ok || existing.Expired < v.Expired {
+		if !ok {
 			m.Entries[k] = v
+			continue
+		}
+
+		// merge if the existing one has older version
+		if merged, changed := existing.merge(v); changed {
+			m.Entries[k] = merged
 		}
 	}
-	return newMessageFromEntries(m.PeerID, m.Entries)
+	// use the latest digest
+	if other.Digest != nil {
+		m.Digest = other.Digest
+	}
+	m.Ranges = mergeRangeTombstones(m.Ranges, other.Ranges)
+
+	complete := newMessageFromEntries(m.PeerID, m.Entries)
+	complete.Digest = m.Digest
+	complete.Ranges = append([]rangeTombstone(nil), m.Ranges...)
+	complete.opts = m.opts
+	complete.metrics = m.metrics
+	complete.stats = m.stats
+	return complete
 }
@@ -19,13 +19,13 @@ func TestMessageMerge(t *testing.T) {
 			initial: map[string]entry{},
 			other: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			complete: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -34,23 +34,23 @@ func TestMessageMerge(t *testing.T) {
 			name: "new key",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			other: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -59,19 +59,19 @@ func TestMessageMerge(t *testing.T) {
 			name: "same key diff val",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			other: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 2,
 				},
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 2,
 				},
 			},
@@ -80,19 +80,19 @@ func TestMessageMerge(t *testing.T) {
 			name: "same key same val",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			other: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
@@ -101,23 +101,246 @@ func TestMessageMerge(t *testing.T) {
 			name: "same key dif val same exp",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			other: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 		},
+		{
+			name: "newer version shorter ttl",
+			initial: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 1},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 1},
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 1},
+				},
+			},
+		},
+		{
+			name: "older version longer ttl",
+			initial: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 1},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 2},
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 1},
+				},
+			},
+		},
+		{
+			name: "same clock bigger origin",
+			initial: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 2},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 1},
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 2},
+				},
+			},
+		},
+		{
+			name: "unversioned entry",
+			initial: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 2, Origin: 1},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 11,
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 11,
+				},
+			},
+		},
+		{
+			name: "touch",
+			initial: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 1},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Expired:  5,
+					Version:  version{Clock: 2, Origin: 2},
+					MetaOnly: true,
+					Base:     version{Clock: 1, Origin: 1},
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 2},
+				},
+			},
+		},
+		{
+			name: "touch of other value",
+			initial: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 1},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Expired:  5,
+					Version:  version{Clock: 3, Origin: 2},
+					MetaOnly: true,
+					Base:     version{Clock: 2, Origin: 1},
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 1},
+				},
+			},
+		},
+		{
+			name: "value of pending touch",
+			initial: map[string]entry{
+				"key1": {
+					Expired:  5,
+					Version:  version{Clock: 2, Origin: 2},
+					MetaOnly: true,
+					Base:     version{Clock: 1, Origin: 1},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 1},
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 2},
+				},
+			},
+		},
+		{
+			name: "touches of the same value",
+			initial: map[string]entry{
+				"key1": {
+					Expired:  100,
+					Version:  version{Clock: 2, Origin: 1},
+					MetaOnly: true,
+					Base:     version{Clock: 1, Origin: 1},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Expired:  200,
+					Version:  version{Clock: 3, Origin: 1},
+					MetaOnly: true,
+					Base:     version{Clock: 1, Origin: 1},
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Expired:  200,
+					Version:  version{Clock: 3, Origin: 1},
+					MetaOnly: true,
+					Base:     version{Clock: 1, Origin: 1},
+				},
+			},
+		},
+		{
+			name: "older touch of the same value",
+			initial: map[string]entry{
+				"key1": {
+					Expired:  200,
+					Version:  version{Clock: 3, Origin: 1},
+					MetaOnly: true,
+					Base:     version{Clock: 1, Origin: 1},
+				},
+			},
+			other: map[string]entry{
+				"key1": {
+					Expired:  100,
+					Version:  version{Clock: 2, Origin: 2},
+					MetaOnly: true,
+					Base:     version{Clock: 1, Origin: 1},
+				},
+			},
+			complete: map[string]entry{
+				"key1": {
+					Expired:  200,
+					Version:  version{Clock: 3, Origin: 1},
+					MetaOnly: true,
+					Base:     version{Clock: 1, Origin: 1},
+				},
+			},
+		},
 	}
 
 	var (
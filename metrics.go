@@ -0,0 +1,52 @@
+package bcache
+
+import (
+	"time"
+)
+
+// Metrics defines interface to be implemented by the metrics collector of bcache.
+//
+// The methods are called synchronously in the hot path,
+// so they must be fast and safe for concurrent use.
+// PrometheusMetrics is the ready-made implementation.
+type Metrics interface {
+	// Hit is called when the key is found by Get
+	Hit()
+
+	// Miss is called when the key is not found by Get
+	Miss()
+
+	// Evicted is called when a key is evicted because the cache is full
+	Evicted()
+
+	// KeysChanged is called with the change of number of the keys in the cache,
+	// including the tombstones of the deleted keys
+	KeysChanged(delta int)
+
+	// GossipSent is called for every gossip message encoded to be sent, with its size in bytes
+	GossipSent(bytes int)
+
+	// GossipReceived is called for every gossip message received, with its size in bytes
+	GossipReceived(bytes int)
+
+	// Merged is called after the received gossip message merged,
+	// with number of the keys it changed
+	Merged(changedKeys int)
+
+	// FillerDone is called after the filler of GetWithFiller returns,
+	// with its latency and error
+	FillerDone(latency time.Duration, err error)
+}
+
+// nopMetrics is metrics that doing nothing
+type nopMetrics struct {
+}
+
+func (nm *nopMetrics) Hit()                                        {}
+func (nm *nopMetrics) Miss()                                       {}
+func (nm *nopMetrics) Evicted()                                    {}
+func (nm *nopMetrics) KeysChanged(delta int)                       {}
+func (nm *nopMetrics) GossipSent(bytes int)                        {}
+func (nm *nopMetrics) GossipReceived(bytes int)                    {}
+func (nm *nopMetrics) Merged(changedKeys int)                      {}
+func (nm *nopMetrics) FillerDone(latency time.Duration, err error) {}
@@ -1,6 +1,11 @@
 package bcache
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/weaveworks/mesh"
 )
 
@@ -10,11 +15,23 @@ type peer struct {
 	send     mesh.Gossip
 	actionCh chan func()
 	quitCh   chan struct{}
+	doneCh   chan struct{}
 	logger   Logger
+	clock    *hlc
+
+	// number of anti entropy buckets,
+	// anti entropy mode is disabled if it is 0
+	digestBuckets int
+
+	stats peerStats
+	acks  *ackWaiters
+
+	seenMux  sync.Mutex
+	lastSeen map[mesh.PeerName]time.Time // last time a gossip message received from the peer
 }
 
-func newPeer(name mesh.PeerName, maxKeys int, logger Logger) (*peer, error) {
-	cc, err := newCache(maxKeys)
+func newPeer(name mesh.PeerName, cfg Config) (*peer, error) {
+	cc, err := newCache(name, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -25,7 +42,13 @@ func newPeer(name mesh.PeerName, maxKeys int, logger Logger) (*peer, error) {
 		send:     nil, // must be registered
 		actionCh: make(chan func()),
 		quitCh:   make(chan struct{}),
-		logger:   logger,
+		doneCh:   make(chan struct{}),
+		logger:   cfg.Logger,
+		clock:    newHLC(maxClockDrift(cfg)),
+		lastSeen: make(map[mesh.PeerName]time.Time),
+		acks:     newAckWaiters(),
+
+		digestBuckets: digestBuckets(cfg),
 	}
 	go p.loop()
 	return p, nil
@@ -33,13 +56,24 @@ func newPeer(name mesh.PeerName, maxKeys int, logger Logger) (*peer, error) {
 
 // register the result of a mesh.Router.NewGossip.
 func (p *peer) register(send mesh.Gossip) {
+	c := make(chan struct{})
+
 	p.actionCh <- func() {
+		defer close(c)
 		p.send = send
 	}
+
+	<-c // wait for it to be finished
 }
 
 // Gossip implements mesh.Gossiper.Gossip
+//
+// In anti entropy mode, it only returns the digest of our state,
+// the entries will be exchanged later by the repair process
 func (p *peer) Gossip() mesh.GossipData {
+	if p.digestBuckets > 0 {
+		return p.cc.digestMessage(p.digestBuckets)
+	}
 	return p.cc.Messages()
 }
 
@@ -48,10 +82,17 @@ func (p *peer) Gossip() mesh.GossipData {
 //
 // It implements mesh.Gossiper.OnGossip
 func (p *peer) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
+	if p.closed() {
+		return
+	}
+	p.cc.received(len(buf))
+
 	msg, err := newMessageFromBuf(buf)
 	if err != nil {
 		return
 	}
+	p.seen(msg.PeerID)
+	p.updateClock(msg)
 
 	var deltaMsg *message
 
@@ -60,10 +101,33 @@ func (p *peer) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
 		deltaMsg = delta.(*message)
 	}
 
+	if len(msg.Digest) > 0 && msg.PeerID != p.name {
+		p.repair(msg.PeerID, msg.Digest)
+	}
+
 	p.logger.Debugf("[%d]OnGossip %v => delta %v", p.name, msg, deltaMsg)
 	return
 }
 
+// repair compares the received digest with ours.
+// It sends our entries of the different buckets to the digest sender,
+// and ask the sender to send back its entries of those buckets.
+func (p *peer) repair(src mesh.PeerName, digest []uint64) {
+	numBuckets := len(digest)
+
+	buckets := diffBuckets(digest, p.cc.digest(numBuckets))
+	if len(buckets) == 0 {
+		return
+	}
+
+	m := p.cc.newMessage(0)
+	m.Entries = p.cc.bucketEntries(buckets, numBuckets)
+	m.Repair = buckets
+
+	p.logger.Debugf("[%d]repair %d buckets with %v", p.name, len(buckets), src)
+	go p.unicast(src, m)
+}
+
 // OnGossipBroadcast merges received data into state and returns a
 // representation of the received data (typically a delta) for further
 // propagation.
@@ -73,10 +137,17 @@ func (p *peer) OnGossipBroadcast(src mesh.PeerName, update []byte) (received mes
 	if src == p.name { // message from ourself, is it possible?
 		return
 	}
+	if p.closed() {
+		return
+	}
+	p.cc.received(len(update))
+
 	msg, err := newMessageFromBuf(update)
 	if err != nil {
 		return
 	}
+	p.seen(src)
+	p.updateClock(msg)
 
 	var recvMsg *message
 
@@ -89,75 +160,392 @@ func (p *peer) OnGossipBroadcast(src mesh.PeerName, update []byte) (received mes
 
 }
 
+// OnGossipUnicast merges received data into state.
+//
+// It implements mesh.Gossiper.OnGossipUnicast
 func (p *peer) OnGossipUnicast(src mesh.PeerName, update []byte) error {
+	if p.closed() {
+		return nil
+	}
+	p.cc.received(len(update))
+
 	msg, err := newMessageFromBuf(update)
 	if err != nil {
 		return err
 	}
+	p.seen(src)
+	p.updateClock(msg)
 	p.cc.mergeComplete(msg)
+
+	// acknowledge after the entries have been merged
+	p.ack(src, msg)
+	if len(msg.Acks) > 0 {
+		p.acks.done(src, msg.Acks)
+	}
+
+	if len(msg.Repair) > 0 && p.digestBuckets > 0 {
+		// send back our entries of the requested buckets,
+		// except the one we just received
+		m := p.cc.newMessage(0)
+		for key, e := range p.cc.bucketEntries(msg.Repair, p.digestBuckets) {
+			if received, ok := msg.Entries[key]; ok && entryHash(key, received) == entryHash(key, e) {
+				continue
+			}
+			m.Entries[key] = e
+		}
+		if len(m.Entries) > 0 {
+			go p.unicast(src, m)
+		}
+	}
 	return nil
 }
 
-func (p *peer) Set(key, val string, expiredTimestamp int64) {
-	c := make(chan struct{})
+func (p *peer) Set(ctx context.Context, key string, val []byte, expiredTimestamp int64) error {
+	_, _, err := p.setIf(ctx, key, val, expiredTimestamp, nil)
+	return err
+}
 
-	p.actionCh <- func() {
-		defer close(c)
+// SetIf sets the value of the given key only if cond returns true.
+// cond is called with the current value, atomically with the other changes
+// made to this peer. nil cond always sets the value.
+//
+// It returns true if the value has been set
+func (p *peer) SetIf(ctx context.Context, key string, val []byte, expiredTimestamp int64, cond func(cur []byte, exists bool) bool) (bool, error) {
+	_, ok, err := p.setIf(ctx, key, val, expiredTimestamp, cond)
+	return ok, err
+}
+
+// setIf is SetIf which also returns the entry which has been set
+func (p *peer) setIf(ctx context.Context, key string, val []byte, expiredTimestamp int64, cond func(cur []byte, exists bool) bool) (entry, bool, error) {
+	var (
+		e  entry
+		ok bool
+	)
 
+	err := p.do(ctx, func() {
 		// set our cache
-		p.cc.Set(key, val, expiredTimestamp, 0)
+		e = entry{
+			Val:     val,
+			Expired: expiredTimestamp,
+			Version: p.newVersion(),
+		}
+		if ok = p.cc.SetIf(key, e, cond); !ok {
+			return
+		}
+		atomic.AddUint64(&p.stats.sets, 1)
+		p.cc.notify(key, e, p.name)
 
 		// construct & send the message
-		m := newMessage(p.name, 1)
-		m.add(key, val, expiredTimestamp, 0)
+		m := p.cc.newMessage(1)
+		m.add(key, e)
 
 		p.broadcast(m)
-	}
+	})
+	return e, ok, err
+}
 
-	<-c // wait for it to be finished
+// Delete deletes the given key, it returns true if the key exists
+func (p *peer) Delete(ctx context.Context, key string, deleteTimestamp int64) (bool, error) {
+	_, exist, err := p.deleteKey(ctx, key, deleteTimestamp)
+	return exist, err
 }
 
-func (p *peer) Delete(key string, deleteTimestamp int64) bool {
+// deleteKey is Delete which also returns the entry of the deletion
+func (p *peer) deleteKey(ctx context.Context, key string, deleteTimestamp int64) (entry, bool, error) {
 	var (
-		c     = make(chan struct{})
+		e     entry
 		exist bool
 	)
 
-	p.actionCh <- func() {
-		defer close(c)
-
+	err := p.do(ctx, func() {
 		// delete from our cache
-		val, expired, exist := p.cc.Delete(key, deleteTimestamp)
+		e, exist = p.cc.Delete(key, deleteTimestamp, p.newVersion())
 		if !exist {
 			return
 		}
+		atomic.AddUint64(&p.stats.deletes, 1)
+		p.cc.notify(key, e, p.name)
 
 		// construct & send the message
-		m := newMessage(p.name, 1)
-		m.add(key, val, expired, deleteTimestamp)
+		m := p.cc.newMessage(1)
+		m.add(key, e)
 
 		p.broadcast(m)
+	})
+	return e, exist, err
+}
+
+// Invalidate writes tombstone of the given key which doesn't carry the value,
+// and broadcast it even if the key doesn't exist in our cache
+func (p *peer) Invalidate(ctx context.Context, key string, deleteTimestamp int64) error {
+	return p.do(ctx, func() {
+		e := p.cc.Invalidate(key, deleteTimestamp, p.newVersion())
+		atomic.AddUint64(&p.stats.deletes, 1)
+		p.cc.notify(key, e, p.name)
+
+		m := p.cc.newMessage(1)
+		m.add(key, e)
+
+		p.broadcast(m)
+	})
+}
+
+// SetMulti sets the values of the given keys
+// and broadcast all of them in one message
+func (p *peer) SetMulti(ctx context.Context, vals map[string][]byte, expiredTimestamp int64) error {
+	return p.do(ctx, func() {
+		m := p.cc.newMessage(len(vals))
+		for key, val := range vals {
+			e := entry{
+				Val:     val,
+				Expired: expiredTimestamp,
+				Version: p.newVersion(),
+			}
+			// atomic with the merges of the received data
+			p.cc.SetIf(key, e, nil)
+			p.cc.notify(key, e, p.name)
+			m.add(key, e)
+		}
+		atomic.AddUint64(&p.stats.sets, uint64(len(vals)))
+
+		p.broadcast(m)
+	})
+}
+
+// DeleteMulti deletes the given keys
+// and broadcast all of the deletions in one message.
+// It returns number of the deleted keys.
+func (p *peer) DeleteMulti(ctx context.Context, keys []string, deleteTimestamp int64) (int, error) {
+	var deleted int
+
+	err := p.do(ctx, func() {
+		m := p.cc.newMessage(len(keys))
+		for _, key := range keys {
+			e, exist := p.cc.Delete(key, deleteTimestamp, p.newVersion())
+			if !exist {
+				continue
+			}
+			p.cc.notify(key, e, p.name)
+			m.add(key, e)
+		}
+		if deleted = len(m.Entries); deleted == 0 {
+			return
+		}
+		atomic.AddUint64(&p.stats.deletes, uint64(deleted))
+
+		p.broadcast(m)
+	})
+	return deleted, err
+}
+
+// updateClock updates our clock with the versions of the received message.
+// The changes whose version is too far ahead are dropped from the message,
+// they will be accepted once our clock catches up.
+func (p *peer) updateClock(msg *message) {
+	if n := msg.dropNewer(p.clock.limit()); n > 0 {
+		p.logger.Errorf("[%d]clock of %v is too far ahead, %d changes are dropped", p.name, msg.PeerID, n)
+	}
+	p.clock.Update(msg.maxClock())
+}
+
+// maxClockDrift returns the max clock drift of the given config
+func maxClockDrift(cfg Config) time.Duration {
+	drift := cfg.MaxClockDrift
+	if drift <= 0 {
+		drift = defaultMaxClockDrift
+	}
+	return time.Duration(drift) * time.Second
+}
+
+// Touch updates the expiration timestamp of the given key
+// and broadcast the change without the value.
+// It returns false if the key not exists.
+func (p *peer) Touch(ctx context.Context, key string, expiredTimestamp int64) (bool, error) {
+	var exist bool
+
+	err := p.do(ctx, func() {
+		var meta entry
+		meta, exist = p.cc.Touch(key, expiredTimestamp, p.newVersion())
+		if !exist {
+			return
+		}
+
+		// construct & send the message
+		m := p.cc.newMessage(1)
+		if p.cc.wireOpts.legacyJSON {
+			// older peers don't understand metadata only entry
+			val, _ := p.cc.peek(key)
+			m.add(key, val.entry())
+		} else {
+			m.add(key, meta)
+		}
+
+		p.broadcast(m)
+	})
+	return exist, err
+}
+
+// do executes f in the peer loop and waits for it to be finished.
+//
+// It stops waiting and returns the context error if the context is done
+// before the peer loop accepts f, or ErrClosed if the peer has been stopped.
+// Once accepted, f is always executed and do waits for it,
+// so the caller could safely read the result of f.
+func (p *peer) do(ctx context.Context, f func()) error {
+	c := make(chan struct{})
+
+	select {
+	case p.actionCh <- func() {
+		defer close(c)
+		f()
+	}:
+	case <-p.quitCh:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
 	<-c // wait for it to be finished
-	return exist
+	return nil
 }
 
-func (p *peer) Get(key string) (string, bool) {
+// newVersion returns version for a local change
+func (p *peer) newVersion() version {
+	return version{
+		Clock:  p.clock.Now(),
+		Origin: p.name,
+	}
+}
+
+func (p *peer) Get(key string) ([]byte, bool) {
 	return p.cc.Get(key)
 }
 
+// seen records that a gossip message has been received from the given peer
+func (p *peer) seen(name mesh.PeerName) {
+	p.seenMux.Lock()
+	p.lastSeen[name] = time.Now()
+	p.seenMux.Unlock()
+}
+
+// lastSeenAt returns the last time a gossip message received from the given peer,
+// or zero time if there is none
+func (p *peer) lastSeenAt(name mesh.PeerName) time.Time {
+	p.seenMux.Lock()
+	defer p.seenMux.Unlock()
+	return p.lastSeen[name]
+}
+
+// snapshot returns the stats of the peer and its cache
+func (p *peer) snapshot() Stats {
+	st := p.cc.snapshot()
+	st.Sets = atomic.LoadUint64(&p.stats.sets)
+	st.Deletes = atomic.LoadUint64(&p.stats.deletes)
+	return st
+}
+
 func (p *peer) loop() {
+	defer close(p.doneCh)
+
 	for {
 		select {
 		case f := <-p.actionCh:
 			f()
 		case <-p.quitCh:
+			p.drain()
 			return
 		}
 	}
 }
 
+// drain executes the actions which are being sent while the peer is stopped
+func (p *peer) drain() {
+	for {
+		select {
+		case f := <-p.actionCh:
+			f()
+		default:
+			return
+		}
+	}
+}
+
+// stop stops the peer loop and waits for the running actions to be finished,
+// the later actions return ErrClosed.
+func (p *peer) stop() {
+	close(p.quitCh)
+	<-p.doneCh
+}
+
+func (p *peer) closed() bool {
+	select {
+	case <-p.quitCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// handoff sends the entries written by this peer and the range tombstones to the first of the given peers
+// which receives all of them, so the writes which may not be gossiped yet are not lost.
+// It must be called after the peer is stopped, so there is no more local write.
+func (p *peer) handoff(ctx context.Context, peers []mesh.PeerName) error {
+	if p.send == nil || len(peers) == 0 {
+		return nil
+	}
+
+	m := p.cc.newMessage(0)
+	m.Entries = p.cc.originEntries(p.name)
+	m.Ranges = p.cc.ranges.list(time.Now().UnixNano())
+	if len(m.Entries) == 0 && len(m.Ranges) == 0 {
+		return nil
+	}
+	bufs := m.Encode()
+
+	errCh := make(chan error, 1)
+	go func() {
+		var err error
+		for _, dst := range peers {
+			if err = p.unicastBufs(dst, bufs); err == nil {
+				p.logger.Printf("[%d]handed off %d entries to %v", p.name, len(m.Entries), dst)
+				break
+			}
+			p.logger.Errorf("[%d]handoff to %v failed: %v", p.name, dst, err)
+		}
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unicast sends the message to the given peer.
+// It must not be called from the mesh receiving goroutine,
+// because it could block on the network.
+func (p *peer) unicast(dst mesh.PeerName, msg *message) {
+	if p.send == nil {
+		return
+	}
+	if err := p.unicastBufs(dst, msg.Encode()); err != nil {
+		p.logger.Errorf("[%d]unicast to %v failed: %v", p.name, dst, err)
+	}
+}
+
+// unicastBufs sends the encoded message to the given peer,
+// it stops on the first error.
+func (p *peer) unicastBufs(dst mesh.PeerName, bufs [][]byte) error {
+	for _, buf := range bufs {
+		if err := p.send.GossipUnicast(dst, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *peer) broadcast(msg *message) {
 	if p.send == nil {
 		return
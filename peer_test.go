@@ -1,7 +1,13 @@
 package bcache
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/weaveworks/mesh"
@@ -19,13 +25,13 @@ func TestPeerOnGossip(t *testing.T) {
 			initial: map[string]entry{},
 			newMsg: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			delta: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -34,19 +40,19 @@ func TestPeerOnGossip(t *testing.T) {
 			name: "new key",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			newMsg: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			delta: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -55,19 +61,19 @@ func TestPeerOnGossip(t *testing.T) {
 			name: "same key diff val",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			newMsg: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 2,
 				},
 			},
 			delta: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 2,
 				},
 			},
@@ -76,13 +82,13 @@ func TestPeerOnGossip(t *testing.T) {
 			name: "same key same val",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			newMsg: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
@@ -92,13 +98,13 @@ func TestPeerOnGossip(t *testing.T) {
 			name: "same key dif val same exp",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			newMsg: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -108,7 +114,7 @@ func TestPeerOnGossip(t *testing.T) {
 			name: "delete",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
@@ -120,12 +126,53 @@ func TestPeerOnGossip(t *testing.T) {
 			},
 			delta: map[string]entry{
 				"key1": {
-					Val:     "",
 					Expired: 2,
 					Deleted: 1,
 				},
 			},
 		},
+		{
+			name: "newer version shorter ttl",
+			initial: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 1},
+				},
+			},
+			newMsg: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 3},
+				},
+			},
+			delta: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 3},
+				},
+			},
+		},
+		{
+			name: "older version longer ttl",
+			initial: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 5,
+					Version: version{Clock: 2, Origin: 1},
+				},
+			},
+			newMsg: map[string]entry{
+				"key1": {
+					Val:     []byte("val2"),
+					Expired: 10,
+					Version: version{Clock: 1, Origin: 3},
+				},
+			},
+			delta: nil,
+		},
 	}
 
 	var (
@@ -135,7 +182,7 @@ func TestPeerOnGossip(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			p, err := newPeer(peerID1, maxKeys, &nopLogger{})
+			p, err := newPeer(peerID1, Config{MaxKeys: maxKeys, Logger: &nopLogger{}})
 			require.NoError(t, err)
 
 			// initial
@@ -169,13 +216,13 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 			initial: map[string]entry{},
 			broadcast: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			delta: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -184,19 +231,19 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 			name: "new key",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			broadcast: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			delta: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -205,19 +252,19 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 			name: "same key diff val",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			broadcast: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 2,
 				},
 			},
 			delta: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 2,
 				},
 			},
@@ -226,13 +273,13 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 			name: "same key same val",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			broadcast: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
@@ -242,13 +289,13 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 			name: "same key dif val same exp",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			broadcast: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -258,7 +305,7 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 			name: "delete",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
@@ -270,7 +317,6 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 			},
 			delta: map[string]entry{
 				"key1": {
-					Val:     "",
 					Expired: 2,
 					Deleted: 1,
 				},
@@ -285,7 +331,7 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			p, err := newPeer(peerID1, maxKeys, &nopLogger{})
+			p, err := newPeer(peerID1, Config{MaxKeys: maxKeys, Logger: &nopLogger{}})
 			require.NoError(t, err)
 
 			// initial
@@ -315,13 +361,13 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 			initial: map[string]entry{},
 			newMsg: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			complete: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -330,23 +376,23 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 			name: "new key",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			newMsg: map[string]entry{
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 				"key2": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
@@ -355,19 +401,19 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 			name: "same key diff val",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			newMsg: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 2,
 				},
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 2,
 				},
 			},
@@ -376,19 +422,19 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 			name: "same key same val",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			newMsg: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
@@ -397,19 +443,19 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 			name: "same key dif val same exp",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
 			newMsg: map[string]entry{
 				"key1": {
-					Val:     "val2",
+					Val:     []byte("val2"),
 					Expired: 1,
 				},
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
@@ -418,7 +464,7 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 			name: "delete",
 			initial: map[string]entry{
 				"key1": {
-					Val:     "val1",
+					Val:     []byte("val1"),
 					Expired: 1,
 				},
 			},
@@ -430,7 +476,6 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 			},
 			complete: map[string]entry{
 				"key1": {
-					Val:     "",
 					Expired: 2,
 					Deleted: 1,
 				},
@@ -445,7 +490,7 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			p, err := newPeer(peerID1, maxKeys, &nopLogger{})
+			p, err := newPeer(peerID1, Config{MaxKeys: maxKeys, Logger: &nopLogger{}})
 			require.NoError(t, err)
 
 			// initial
@@ -462,3 +507,669 @@ func TestPeerOnGossipUnicast(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerOnGossipChunks(t *testing.T) {
+	const numKeys = 95
+
+	cfg := Config{
+		MaxKeys:         1000,
+		Logger:          &nopLogger{},
+		GossipChunkKeys: 10,
+	}
+
+	p1, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+
+	p2, err := newPeer(mesh.PeerName(2), cfg)
+	require.NoError(t, err)
+
+	for i := 0; i < numKeys; i++ {
+		p1.cc.Set(fmt.Sprintf("key-%d", i), entry{Val: []byte("val"), Expired: time.Now().Add(time.Hour).UnixNano()})
+	}
+
+	bufs := p1.Gossip().Encode()
+	require.Len(t, bufs, 10)
+
+	// every chunk merged on its own
+	for _, buf := range bufs {
+		delta, err := p2.OnGossip(buf)
+		require.NoError(t, err)
+		require.True(t, len(delta.(*message).Entries) <= cfg.GossipChunkKeys)
+	}
+
+	require.Equal(t, p1.cc.Messages().Entries, p2.cc.Messages().Entries)
+}
+
+// testGossip delivers the unicast messages directly to the destination peer,
+// and records the broadcast messages
+type testGossip struct {
+	mux        sync.Mutex
+	src        mesh.PeerName
+	peers      map[mesh.PeerName]*peer
+	unicasts   int
+	broadcasts []*message
+}
+
+func (g *testGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	g.mux.Lock()
+	g.unicasts++
+	g.mux.Unlock()
+	return g.peers[dst].OnGossipUnicast(g.src, msg)
+}
+
+func (g *testGossip) GossipBroadcast(update mesh.GossipData) {
+	g.mux.Lock()
+	g.broadcasts = append(g.broadcasts, update.(*message))
+	g.mux.Unlock()
+}
+
+func (g *testGossip) GossipNeighbourSubset(update mesh.GossipData) {}
+
+func (g *testGossip) numUnicasts() int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.unicasts
+}
+
+func TestPeerAntiEntropy(t *testing.T) {
+	cfg := Config{
+		MaxKeys:            1000,
+		Logger:             &nopLogger{},
+		AntiEntropy:        true,
+		AntiEntropyBuckets: 16,
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+
+	p1, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+
+	p2, err := newPeer(mesh.PeerName(2), cfg)
+	require.NoError(t, err)
+
+	peers := map[mesh.PeerName]*peer{p1.name: p1, p2.name: p2}
+	g1 := &testGossip{src: p1.name, peers: peers}
+	g2 := &testGossip{src: p2.name, peers: peers}
+	p1.register(g1)
+	p2.register(g2)
+
+	for i := 0; i < 50; i++ {
+		p1.cc.Set(fmt.Sprintf("key1-%d", i), entry{Val: []byte("val1"), Expired: expired})
+		p2.cc.Set(fmt.Sprintf("key2-%d", i), entry{Val: []byte("val2"), Expired: expired})
+	}
+	p1.cc.Set("same", entry{Val: []byte("same"), Expired: expired})
+	p2.cc.Set("same", entry{Val: []byte("same"), Expired: expired})
+
+	// periodic gossip only contains the digest
+	digest := p1.Gossip().(*message)
+	require.Empty(t, digest.Entries)
+	require.Len(t, digest.Digest, cfg.AntiEntropyBuckets)
+
+	delta, err := p2.OnGossip(digest.Encode()[0])
+	require.NoError(t, err)
+	require.Nil(t, delta)
+
+	// both peers exchange the different buckets
+	require.Eventually(t, func() bool {
+		return len(p1.cc.Messages().Entries) == 101 && len(p2.cc.Messages().Entries) == 101
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, p1.cc.Messages().Entries, p2.cc.Messages().Entries)
+
+	// in sync: no more repair
+	numUnicasts := g1.numUnicasts() + g2.numUnicasts()
+	_, err = p2.OnGossip(p1.Gossip().Encode()[0])
+	require.NoError(t, err)
+	_, err = p1.OnGossip(p2.Gossip().Encode()[0])
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, numUnicasts, g1.numUnicasts()+g2.numUnicasts())
+}
+
+// changes of a peer whose clock is too far ahead don't win the later changes
+func TestPeerClockDrift(t *testing.T) {
+	cfg := Config{
+		MaxKeys:       1000,
+		Logger:        &nopLogger{},
+		MaxClockDrift: 60,
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+	ctx := context.Background()
+
+	var peers []*peer
+	var gossips []*testGossip
+	for i := 1; i <= 3; i++ {
+		p, err := newPeer(mesh.PeerName(i), cfg)
+		require.NoError(t, err)
+		g := &testGossip{src: p.name}
+		p.register(g)
+		peers = append(peers, p)
+		gossips = append(gossips, g)
+	}
+	p1, p2, p3 := peers[0], peers[1], peers[2]
+
+	// clock of peer 2 runs an hour ahead
+	p2.clock.now = func() time.Time { return time.Now().Add(time.Hour) }
+	require.NoError(t, p2.Set(ctx, "key", []byte("skewed"), expired))
+
+	for _, p := range []*peer{p1, p3} {
+		_, err := p.OnGossipBroadcast(p2.name, gossips[1].broadcasts[0].Encode()[0])
+		require.NoError(t, err)
+		_, ok := p.Get("key")
+		require.False(t, ok)
+	}
+
+	// the later change of peer 1 survives the full state of peer 3
+	require.NoError(t, p1.Set(ctx, "key", []byte("new"), expired))
+	_, err := p3.OnGossipBroadcast(p1.name, gossips[0].broadcasts[0].Encode()[0])
+	require.NoError(t, err)
+	_, err = p1.OnGossip(p3.Gossip().Encode()[0])
+	require.NoError(t, err)
+
+	for _, p := range []*peer{p1, p3} {
+		val, ok := p.Get("key")
+		require.True(t, ok)
+		require.Equal(t, []byte("new"), val)
+	}
+}
+
+func TestPeerTouch(t *testing.T) {
+	cfg := Config{
+		MaxKeys: 1000,
+		Logger:  &nopLogger{},
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+	ctx := context.Background()
+
+	p1, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+
+	p2, err := newPeer(mesh.PeerName(2), cfg)
+	require.NoError(t, err)
+
+	g1 := &testGossip{src: p1.name}
+	p1.register(g1)
+
+	// sync the value to p2
+	ok, err := p1.Touch(ctx, "key", expired)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, p1.Set(ctx, "key", []byte("val"), expired))
+	_, err = p2.OnGossipBroadcast(p1.name, g1.broadcasts[0].Encode()[0])
+	require.NoError(t, err)
+
+	// touch only broadcast the metadata
+	newExpired := expired + int64(time.Hour)
+	ok, err = p1.Touch(ctx, "key", newExpired)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, g1.broadcasts, 2)
+
+	touch := g1.broadcasts[1].Entries["key"]
+	require.True(t, touch.MetaOnly)
+	require.Nil(t, touch.Val)
+
+	delta, err := p2.OnGossipBroadcast(p1.name, g1.broadcasts[1].Encode()[0])
+	require.NoError(t, err)
+	require.Equal(t, touch, delta.(*message).Entries["key"])
+
+	e1, _ := p1.cc.peek("key")
+	e2, _ := p2.cc.peek("key")
+	require.Equal(t, e1, e2)
+	require.Equal(t, []byte("val"), e2.value)
+	require.Equal(t, newExpired, e2.expired)
+
+	// peer which doesn't have the value ignore the metadata
+	p3, err := newPeer(mesh.PeerName(3), cfg)
+	require.NoError(t, err)
+
+	delta, err = p3.OnGossip(g1.broadcasts[1].Encode()[0])
+	require.NoError(t, err)
+	require.Nil(t, delta)
+	_, ok = p3.cc.peek("key")
+	require.False(t, ok)
+}
+
+func TestPeerInvalidate(t *testing.T) {
+	cfg := Config{
+		MaxKeys: 1000,
+		Logger:  &nopLogger{},
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+	deleteTs := time.Now().Add(time.Minute).UnixNano()
+	ctx := context.Background()
+
+	p1, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+
+	p2, err := newPeer(mesh.PeerName(2), cfg)
+	require.NoError(t, err)
+
+	p3, err := newPeer(mesh.PeerName(3), cfg)
+	require.NoError(t, err)
+
+	g1 := &testGossip{src: p1.name}
+	p1.register(g1)
+	g2 := &testGossip{src: p2.name}
+	p2.register(g2)
+
+	// only p1 and p3 have the value
+	require.NoError(t, p1.Set(ctx, "key", []byte("val"), expired))
+	set := g1.broadcasts[0].Encode()[0]
+	_, err = p3.OnGossipBroadcast(p1.name, set)
+	require.NoError(t, err)
+
+	// delete of unknown key sends nothing
+	exist, err := p2.Delete(ctx, "key", deleteTs)
+	require.NoError(t, err)
+	require.False(t, exist)
+	require.Empty(t, g2.broadcasts)
+
+	// invalidate sends the tombstone without the value
+	require.NoError(t, p2.Invalidate(ctx, "key", deleteTs))
+	require.Len(t, g2.broadcasts, 1)
+	tombstone := g2.broadcasts[0].Entries["key"]
+	require.Nil(t, tombstone.Val)
+	require.Equal(t, deleteTs, tombstone.Deleted)
+
+	for _, p := range []*peer{p1, p3} {
+		_, err = p.OnGossipBroadcast(p2.name, g2.broadcasts[0].Encode()[0])
+		require.NoError(t, err)
+	}
+
+	// the late gossip of the old value is ignored
+	_, err = p3.OnGossipBroadcast(p1.name, set)
+	require.NoError(t, err)
+
+	for _, p := range []*peer{p1, p2, p3} {
+		val, ok := p.Get("key")
+		require.False(t, ok)
+		require.Nil(t, val)
+
+		e, ok := p.cc.peek("key")
+		require.True(t, ok)
+		require.Equal(t, tombstone.Version, e.version)
+	}
+}
+
+func TestPeerDeleteRange(t *testing.T) {
+	cfg := Config{
+		MaxKeys: 1000,
+		Logger:  &nopLogger{},
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+	deleteTs := time.Now().Add(time.Minute).UnixNano()
+	ctx := context.Background()
+
+	p1, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+
+	p2, err := newPeer(mesh.PeerName(2), cfg)
+	require.NoError(t, err)
+
+	g1 := &testGossip{src: p1.name}
+	p1.register(g1)
+	g2 := &testGossip{src: p2.name}
+	p2.register(g2)
+
+	for _, key := range []string{"tenant-1/a", "tenant-1/b", "tenant-2/a"} {
+		require.NoError(t, p1.Set(ctx, key, []byte("val"), expired))
+	}
+	sets := make([][]byte, 0, len(g1.broadcasts))
+	for _, m := range g1.broadcasts {
+		buf := m.Encode()[0]
+		sets = append(sets, buf)
+		_, err = p2.OnGossipBroadcast(p1.name, buf)
+		require.NoError(t, err)
+	}
+
+	// single range tombstone is sent
+	require.NoError(t, p1.DeleteRange(ctx, "tenant-1/", deleteTs))
+	require.Len(t, g1.broadcasts, 4)
+	rangeMsg := g1.broadcasts[3]
+	require.Empty(t, rangeMsg.Entries)
+	require.Len(t, rangeMsg.Ranges, 1)
+	require.Equal(t, uint64(2), p1.snapshot().Deletes)
+
+	delta, err := p2.OnGossipBroadcast(p1.name, rangeMsg.Encode()[0])
+	require.NoError(t, err)
+	require.Equal(t, rangeMsg.Ranges, delta.(*message).Ranges)
+
+	// known range tombstone is not new
+	delta, err = p2.OnGossip(rangeMsg.Encode()[0])
+	require.NoError(t, err)
+	require.Nil(t, delta)
+
+	// the write after the deletion survives
+	require.NoError(t, p2.Set(ctx, "tenant-1/new", []byte("new"), expired))
+	_, err = p1.OnGossipBroadcast(p2.name, g2.broadcasts[0].Encode()[0])
+	require.NoError(t, err)
+
+	// the late gossip of the old values is ignored
+	for _, buf := range sets {
+		_, err = p2.OnGossipBroadcast(p1.name, buf)
+		require.NoError(t, err)
+	}
+
+	for _, p := range []*peer{p1, p2} {
+		_, ok := p.Get("tenant-1/a")
+		require.False(t, ok)
+		_, ok = p.Get("tenant-1/b")
+		require.False(t, ok)
+
+		val, ok := p.Get("tenant-2/a")
+		require.True(t, ok)
+		require.Equal(t, []byte("val"), val)
+
+		val, ok = p.Get("tenant-1/new")
+		require.True(t, ok)
+		require.Equal(t, []byte("new"), val)
+	}
+
+	// the range tombstone is gossiped to the peer which missed it
+	p3, err := newPeer(mesh.PeerName(3), cfg)
+	require.NoError(t, err)
+
+	_, err = p3.OnGossip(p1.Gossip().Encode()[0])
+	require.NoError(t, err)
+	_, err = p3.OnGossip(sets[0])
+	require.NoError(t, err)
+	_, ok := p3.Get("tenant-1/a")
+	require.False(t, ok)
+	_, ok = p3.Get("tenant-1/new")
+	require.True(t, ok)
+}
+
+// two peers set the same key at the same time
+func TestPeerSetIfConflict(t *testing.T) {
+	cfg := Config{
+		MaxKeys: 1000,
+		Logger:  &nopLogger{},
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+	ctx := context.Background()
+	notExists := func(cur []byte, exists bool) bool {
+		return !exists
+	}
+
+	p1, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+	g1 := &testGossip{src: p1.name}
+	p1.register(g1)
+
+	p2, err := newPeer(mesh.PeerName(2), cfg)
+	require.NoError(t, err)
+	g2 := &testGossip{src: p2.name}
+	p2.register(g2)
+
+	// make both changes happen at the same clock
+	now := time.Now()
+	p1.clock.now = func() time.Time { return now }
+	p2.clock.now = func() time.Time { return now }
+
+	ok, err := p1.SetIf(ctx, "key", []byte("val1"), expired, notExists)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = p2.SetIf(ctx, "key", []byte("val2"), expired, notExists)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// exchange the changes
+	_, err = p1.OnGossipBroadcast(p2.name, g2.broadcasts[0].Encode()[0])
+	require.NoError(t, err)
+	_, err = p2.OnGossipBroadcast(p1.name, g1.broadcasts[0].Encode()[0])
+	require.NoError(t, err)
+
+	// peer with bigger ID wins
+	val1, ok := p1.Get("key")
+	require.True(t, ok)
+	val2, ok := p2.Get("key")
+	require.True(t, ok)
+	require.Equal(t, []byte("val2"), val1)
+	require.Equal(t, []byte("val2"), val2)
+}
+
+func TestPeerMulti(t *testing.T) {
+	const numKeys = 2500
+
+	cfg := Config{
+		MaxKeys:         10000,
+		Logger:          &nopLogger{},
+		GossipChunkKeys: 1000,
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+	ctx := context.Background()
+
+	p1, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+	g1 := &testGossip{src: p1.name}
+	p1.register(g1)
+
+	p2, err := newPeer(mesh.PeerName(2), cfg)
+	require.NoError(t, err)
+
+	vals := make(map[string][]byte, numKeys)
+	keys := make([]string, 0, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		vals[key] = []byte(fmt.Sprintf("val-%d", i))
+		keys = append(keys, key)
+	}
+
+	// all keys are sent in one chunked broadcast
+	require.NoError(t, p1.SetMulti(ctx, vals, expired))
+	require.Len(t, g1.broadcasts, 1)
+
+	bufs := g1.broadcasts[0].Encode()
+	require.Len(t, bufs, 3)
+	for _, buf := range bufs {
+		_, err = p2.OnGossipBroadcast(p1.name, buf)
+		require.NoError(t, err)
+	}
+	for key, val := range vals {
+		got, ok := p2.Get(key)
+		require.True(t, ok)
+		require.Equal(t, val, got)
+	}
+
+	// non existing key is not broadcasted
+	deleted, err := p1.DeleteMulti(ctx, append(keys, "unknown"), time.Now().UnixNano())
+	require.NoError(t, err)
+	require.Equal(t, numKeys, deleted)
+	require.Len(t, g1.broadcasts, 2)
+	require.Len(t, g1.broadcasts[1].Entries, numKeys)
+
+	deleted, err = p1.DeleteMulti(ctx, []string{"unknown"}, time.Now().UnixNano())
+	require.NoError(t, err)
+	require.Equal(t, 0, deleted)
+	require.Len(t, g1.broadcasts, 2)
+
+	for _, buf := range g1.broadcasts[1].Encode() {
+		_, err = p2.OnGossipBroadcast(p1.name, buf)
+		require.NoError(t, err)
+	}
+	for _, key := range keys {
+		_, ok := p2.Get(key)
+		require.False(t, ok)
+	}
+}
+
+func TestPeerOnRemoteUpdate(t *testing.T) {
+	expired := time.Now().Add(time.Hour).UnixNano()
+
+	var (
+		mux     sync.Mutex
+		updates = make(map[string]uint64)
+	)
+	cfg := Config{
+		MaxKeys: 1000,
+		Logger:  &nopLogger{},
+		OnRemoteUpdate: func(key string, origin uint64) {
+			mux.Lock()
+			updates[key] = origin
+			mux.Unlock()
+		},
+	}
+
+	p, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+
+	// local change
+	require.NoError(t, p.Set(context.Background(), "local", []byte("val"), expired))
+
+	// change made by peer 3, relayed by peer 2
+	msg := newMessageFromEntries(mesh.PeerName(2), map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: expired,
+			Version: version{Clock: 1, Origin: 3},
+		},
+		// older peer doesn't send the version
+		"key2": {
+			Val:     []byte("val2"),
+			Expired: expired,
+		},
+	})
+	_, err = p.OnGossipBroadcast(mesh.PeerName(2), msg.Encode()[0])
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"key1": 3, "key2": 2}, updates)
+
+	// no changes
+	delete(updates, "key1")
+	delete(updates, "key2")
+	require.NoError(t, p.OnGossipUnicast(mesh.PeerName(2), msg.Encode()[0]))
+	require.Empty(t, updates)
+
+	// deletion
+	msg.Entries = map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: expired,
+			Deleted: time.Now().UnixNano(),
+			Version: version{Clock: 2, Origin: 4},
+		},
+	}
+	require.NoError(t, p.OnGossipUnicast(mesh.PeerName(2), msg.Encode()[0]))
+	require.Equal(t, map[string]uint64{"key1": 4}, updates)
+}
+
+func TestPeerStop(t *testing.T) {
+	const numWriters = 10
+
+	cfg := Config{
+		MaxKeys: 1000,
+		Logger:  &nopLogger{},
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+	ctx := context.Background()
+
+	p1, err := newPeer(mesh.PeerName(1), cfg)
+	require.NoError(t, err)
+
+	p2, err := newPeer(mesh.PeerName(2), cfg)
+	require.NoError(t, err)
+
+	peers := map[mesh.PeerName]*peer{p1.name: p1, p2.name: p2}
+	g1 := &testGossip{src: p1.name, peers: peers}
+	p1.register(g1)
+
+	// entry of the other peer is not handed off
+	p1.cc.Set("remote", entry{Val: []byte("val"), Expired: expired, Version: version{Clock: 1, Origin: 3}})
+	require.NoError(t, p1.Set(ctx, "key", []byte("val"), expired))
+	_, err = p1.Delete(ctx, "key", time.Now().Add(time.Minute).UnixNano())
+	require.NoError(t, err)
+
+	// concurrent writes are either finished or rejected
+	var (
+		wg      sync.WaitGroup
+		written int32
+	)
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			err := p1.Set(ctx, fmt.Sprintf("key-%d", i), []byte("val"), expired)
+			if err == nil {
+				atomic.AddInt32(&written, 1)
+				return
+			}
+			require.Equal(t, ErrClosed, err)
+		}(i)
+	}
+
+	p1.stop()
+	wg.Wait()
+
+	require.Equal(t, ErrClosed, p1.Set(ctx, "closed", []byte("val"), expired))
+	_, err = p1.Touch(ctx, "key-0", expired)
+	require.Equal(t, ErrClosed, err)
+
+	// received gossip is ignored
+	m := p2.cc.newMessage(1)
+	m.add("ignored", entry{Val: []byte("val"), Expired: expired})
+	require.NoError(t, p1.OnGossipUnicast(p2.name, m.Encode()[0]))
+	_, ok := p1.Get("ignored")
+	require.False(t, ok)
+
+	// handoff the writes of p1, including the deletion
+	require.NoError(t, p1.handoff(ctx, []mesh.PeerName{p2.name}))
+	require.Equal(t, 1, g1.numUnicasts())
+	require.Equal(t, int(written)+1, p2.cc.len())
+
+	_, ok = p2.Get("remote")
+	require.False(t, ok)
+	e, ok := p2.cc.peek("key")
+	require.True(t, ok)
+	require.True(t, e.deleted > 0)
+}
+
+func TestPeerWaitAcks(t *testing.T) {
+	cfg := Config{
+		MaxKeys: 1000,
+		Logger:  &nopLogger{},
+	}
+	expired := time.Now().Add(time.Hour).UnixNano()
+	ctx := context.Background()
+
+	peers := make(map[mesh.PeerName]*peer)
+	gossips := make(map[mesh.PeerName]*testGossip)
+	for i := 1; i <= 4; i++ {
+		p, err := newPeer(mesh.PeerName(i), cfg)
+		require.NoError(t, err)
+		peers[p.name] = p
+		gossips[p.name] = &testGossip{src: p.name, peers: peers}
+		p.register(gossips[p.name])
+	}
+	p1 := peers[1]
+
+	// stopped peer never acknowledges
+	peers[4].stop()
+
+	e, _, err := p1.setIf(ctx, "key", []byte("val"), expired, nil)
+	require.NoError(t, err)
+
+	acked, err := p1.waitAcks(ctx, "key", e, []mesh.PeerName{2, 3, 4}, 2)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []uint64{2, 3}, acked)
+	for _, name := range []mesh.PeerName{2, 3} {
+		val, ok := peers[name].Get("key")
+		require.True(t, ok)
+		require.Equal(t, []byte("val"), val)
+	}
+
+	// timeout
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	acked, err = p1.waitAcks(timeoutCtx, "key", e, []mesh.PeerName{2, 3, 4}, 3)
+	require.True(t, errors.Is(err, ErrNotAcked))
+	require.ElementsMatch(t, []uint64{2, 3}, acked)
+
+	// not enough peers
+	_, err = p1.waitAcks(ctx, "key", e, []mesh.PeerName{2}, 2)
+	require.True(t, errors.Is(err, ErrNotAcked))
+
+	// unknown and late acknowledgements are ignored
+	m := peers[2].cc.newMessage(0)
+	m.Acks = []uint64{1, 100}
+	require.NoError(t, p1.OnGossipUnicast(2, m.Encode()[0]))
+}
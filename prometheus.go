@@ -0,0 +1,168 @@
+package bcache
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// default buckets of the filler latency histogram, in seconds
+	defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// PrometheusMetrics is Metrics which exposes the collected metrics
+// in the Prometheus text exposition format.
+//
+// It implements http.Handler, so it could be registered
+// as the metrics endpoint scraped by Prometheus:
+//
+//	metrics := bcache.NewPrometheusMetrics("myapp")
+//	bc, err := bcache.New(bcache.Config{
+//		// other config
+//		Metrics: metrics,
+//	})
+//	http.Handle("/metrics", metrics)
+type PrometheusMetrics struct {
+	namespace string
+
+	hits           uint64
+	misses         uint64
+	evictions      uint64
+	keys           int64
+	gossipSent     uint64
+	gossipSentB    uint64
+	gossipRecv     uint64
+	gossipRecvB    uint64
+	mergedMessages uint64
+	mergedKeys     uint64
+	fillerErrors   uint64
+
+	mux           sync.Mutex // protects the filler latency histogram
+	fillerBuckets []float64
+	fillerCounts  []uint64
+	fillerSum     float64
+	fillerCount   uint64
+}
+
+// NewPrometheusMetrics creates PrometheusMetrics,
+// the name of the metrics are prefixed by the given namespace.
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "bcache"
+	}
+	return &PrometheusMetrics{
+		namespace:     namespace,
+		fillerBuckets: defaultLatencyBuckets,
+		fillerCounts:  make([]uint64, len(defaultLatencyBuckets)),
+	}
+}
+
+// Hit implements Metrics.Hit
+func (pm *PrometheusMetrics) Hit() {
+	atomic.AddUint64(&pm.hits, 1)
+}
+
+// Miss implements Metrics.Miss
+func (pm *PrometheusMetrics) Miss() {
+	atomic.AddUint64(&pm.misses, 1)
+}
+
+// Evicted implements Metrics.Evicted
+func (pm *PrometheusMetrics) Evicted() {
+	atomic.AddUint64(&pm.evictions, 1)
+}
+
+// KeysChanged implements Metrics.KeysChanged
+func (pm *PrometheusMetrics) KeysChanged(delta int) {
+	atomic.AddInt64(&pm.keys, int64(delta))
+}
+
+// GossipSent implements Metrics.GossipSent
+func (pm *PrometheusMetrics) GossipSent(bytes int) {
+	atomic.AddUint64(&pm.gossipSent, 1)
+	atomic.AddUint64(&pm.gossipSentB, uint64(bytes))
+}
+
+// GossipReceived implements Metrics.GossipReceived
+func (pm *PrometheusMetrics) GossipReceived(bytes int) {
+	atomic.AddUint64(&pm.gossipRecv, 1)
+	atomic.AddUint64(&pm.gossipRecvB, uint64(bytes))
+}
+
+// Merged implements Metrics.Merged
+func (pm *PrometheusMetrics) Merged(changedKeys int) {
+	atomic.AddUint64(&pm.mergedMessages, 1)
+	atomic.AddUint64(&pm.mergedKeys, uint64(changedKeys))
+}
+
+// FillerDone implements Metrics.FillerDone
+func (pm *PrometheusMetrics) FillerDone(latency time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&pm.fillerErrors, 1)
+	}
+
+	secs := latency.Seconds()
+
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+
+	for i, le := range pm.fillerBuckets {
+		if secs <= le {
+			pm.fillerCounts[i]++
+		}
+	}
+	pm.fillerSum += secs
+	pm.fillerCount++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (pm *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	pm.writeCounter(bw, "hits_total", "Number of the cache hits.", atomic.LoadUint64(&pm.hits))
+	pm.writeCounter(bw, "misses_total", "Number of the cache misses.", atomic.LoadUint64(&pm.misses))
+	pm.writeCounter(bw, "evictions_total", "Number of the keys evicted because the cache is full.", atomic.LoadUint64(&pm.evictions))
+	pm.writeMetric(bw, "keys", "gauge", "Number of the keys in the cache.", strconv.FormatInt(atomic.LoadInt64(&pm.keys), 10))
+	pm.writeCounter(bw, "gossip_sent_messages_total", "Number of the gossip messages sent.", atomic.LoadUint64(&pm.gossipSent))
+	pm.writeCounter(bw, "gossip_sent_bytes_total", "Size of the gossip messages sent.", atomic.LoadUint64(&pm.gossipSentB))
+	pm.writeCounter(bw, "gossip_received_messages_total", "Number of the gossip messages received.", atomic.LoadUint64(&pm.gossipRecv))
+	pm.writeCounter(bw, "gossip_received_bytes_total", "Size of the gossip messages received.", atomic.LoadUint64(&pm.gossipRecvB))
+	pm.writeCounter(bw, "merged_messages_total", "Number of the received gossip messages merged.", atomic.LoadUint64(&pm.mergedMessages))
+	pm.writeCounter(bw, "merged_keys_total", "Number of the keys changed by the received gossip messages.", atomic.LoadUint64(&pm.mergedKeys))
+	pm.writeCounter(bw, "filler_errors_total", "Number of the filler calls which returned error.", atomic.LoadUint64(&pm.fillerErrors))
+	pm.writeFillerHistogram(bw)
+}
+
+func (pm *PrometheusMetrics) writeCounter(w *bufio.Writer, name, help string, val uint64) {
+	pm.writeMetric(w, name, "counter", help, strconv.FormatUint(val, 10))
+}
+
+func (pm *PrometheusMetrics) writeMetric(w *bufio.Writer, name, typ, help, val string) {
+	name = pm.namespace + "_" + name
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(w, "%s %s\n", name, val)
+}
+
+func (pm *PrometheusMetrics) writeFillerHistogram(w *bufio.Writer) {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+
+	name := pm.namespace + "_filler_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of the filler calls.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, le := range pm.fillerBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), pm.fillerCounts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, pm.fillerCount)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(pm.fillerSum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, pm.fillerCount)
+}
@@ -0,0 +1,112 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	pm := NewPrometheusMetrics("test")
+
+	pm.Hit()
+	pm.Hit()
+	pm.Miss()
+	pm.Evicted()
+	pm.KeysChanged(3)
+	pm.KeysChanged(-1)
+	pm.GossipSent(100)
+	pm.GossipReceived(10)
+	pm.GossipReceived(20)
+	pm.Merged(5)
+	pm.FillerDone(20*time.Millisecond, nil)
+	pm.FillerDone(2*time.Second, errors.New("failed"))
+
+	srv := httptest.NewServer(pm)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		"# TYPE test_hits_total counter",
+		"test_hits_total 2",
+		"test_misses_total 1",
+		"test_evictions_total 1",
+		"# TYPE test_keys gauge",
+		"test_keys 2",
+		"test_gossip_sent_messages_total 1",
+		"test_gossip_sent_bytes_total 100",
+		"test_gossip_received_messages_total 2",
+		"test_gossip_received_bytes_total 30",
+		"test_merged_messages_total 1",
+		"test_merged_keys_total 5",
+		"test_filler_errors_total 1",
+		"# TYPE test_filler_duration_seconds histogram",
+		`test_filler_duration_seconds_bucket{le="0.01"} 0`,
+		`test_filler_duration_seconds_bucket{le="0.025"} 1`,
+		`test_filler_duration_seconds_bucket{le="2.5"} 2`,
+		`test_filler_duration_seconds_bucket{le="+Inf"} 2`,
+		"test_filler_duration_seconds_sum 2.02",
+		"test_filler_duration_seconds_count 2",
+	} {
+		require.Contains(t, strings.Split(string(body), "\n"), line)
+	}
+}
+
+func TestMetricsInstrumentation(t *testing.T) {
+	pm := NewPrometheusMetrics("")
+	bc := newLocalBcacheFromConfig(t, Config{
+		MaxKeys:    2,
+		ShardCount: 1,
+		Metrics:    pm,
+	})
+
+	bc.Set("key1", "val1", 60)
+	bc.Get("key1")
+	bc.Get("key2")
+	bc.Set("key2", "val2", 60)
+	bc.Set("key3", "val3", 60)
+	require.Equal(t, uint64(1), pm.hits)
+	require.Equal(t, uint64(1), pm.misses)
+	require.Equal(t, uint64(1), pm.evictions)
+	require.Equal(t, int64(2), pm.keys)
+
+	// deleted key is a miss
+	bc.Delete("key2")
+	bc.Get("key2")
+	require.Equal(t, uint64(2), pm.misses)
+
+	_, err := bc.GetWithFillerCtx(context.Background(), "key4", func(ctx context.Context, key string) (string, error) {
+		return "", errors.New("failed")
+	}, 60)
+	require.Error(t, err)
+	require.Equal(t, uint64(1), pm.fillerCount)
+	require.Equal(t, uint64(1), pm.fillerErrors)
+
+	// gossip
+	msg := bc.peer.cc.newMessage(1)
+	msg.add("key5", entry{Val: []byte("val5"), Expired: time.Now().Add(time.Hour).UnixNano()})
+	buf := msg.Encode()[0]
+	require.Equal(t, uint64(1), pm.gossipSent)
+	require.Equal(t, uint64(len(buf)), pm.gossipSentB)
+
+	_, err = bc.peer.OnGossipBroadcast(mesh.PeerName(2), buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), pm.gossipRecv)
+	require.Equal(t, uint64(len(buf)), pm.gossipRecvB)
+	require.Equal(t, uint64(1), pm.mergedMessages)
+	require.Equal(t, uint64(1), pm.mergedKeys)
+}
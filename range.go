@@ -0,0 +1,230 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errRangeLegacyEncoding = errors.New("prefix deletion is not supported by the legacy encoding")
+)
+
+// DeleteByPrefix deletes all of the keys which have the given prefix,
+// on all of the peers.
+//
+// The deletion is sent to the other peers as a single range tombstone,
+// which deletes the keys made before it, and is kept for the DeletionDelay
+// to win against the older values which are still being gossiped.
+// The keys set after the deletion are not affected.
+//
+// Empty prefix deletes all of the keys, see Flush.
+func (b *Bcache) DeleteByPrefix(prefix string) error {
+	return b.DeleteByPrefixCtx(context.Background(), prefix)
+}
+
+// DeleteByPrefixCtx is like DeleteByPrefix, but it stops waiting and returns the context error
+// if the context is done before the keys could be deleted.
+func (b *Bcache) DeleteByPrefixCtx(ctx context.Context, prefix string) error {
+	deleteTs := time.Now().Add(b.deletionDelay).UnixNano()
+	return b.peer.DeleteRange(ctx, prefix, deleteTs)
+}
+
+// Flush deletes all of the keys on all of the peers,
+// it is DeleteByPrefix with empty prefix.
+func (b *Bcache) Flush() error {
+	return b.FlushCtx(context.Background())
+}
+
+// FlushCtx is like Flush, but it stops waiting and returns the context error
+// if the context is done before the keys could be deleted.
+func (b *Bcache) FlushCtx(ctx context.Context) error {
+	return b.DeleteByPrefixCtx(ctx, "")
+}
+
+// rangeTombstone deletes all of the keys which have the Prefix
+// and older version than the Version
+type rangeTombstone struct {
+	Prefix  string
+	Deleted int64 // the tombstone is kept until this timestamp
+	Version version
+}
+
+// covers returns true if the given entry of the key is deleted by this tombstone
+func (r rangeTombstone) covers(key string, ver version) bool {
+	return strings.HasPrefix(key, r.Prefix) && ver.compare(r.Version) < 0
+}
+
+// rangeTombstones is the set of the range tombstones which are not removable yet,
+// there is at most one tombstone per prefix, the newest one.
+type rangeTombstones struct {
+	mux    sync.RWMutex
+	ranges map[string]rangeTombstone
+}
+
+func newRangeTombstones() *rangeTombstones {
+	return &rangeTombstones{
+		ranges: make(map[string]rangeTombstone),
+	}
+}
+
+// add adds the given tombstone, it is not kept if it is already removable.
+// It returns false if there is already the same or newer tombstone of the prefix.
+func (rs *rangeTombstones) add(r rangeTombstone, now int64) bool {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	rs.removeExpired(now)
+	if existing, ok := rs.ranges[r.Prefix]; ok && r.Version.compare(existing.Version) <= 0 {
+		return false
+	}
+	if now < r.Deleted {
+		rs.ranges[r.Prefix] = r
+	}
+	return true
+}
+
+// covers returns true if the given entry of the key is deleted by any of the tombstones
+func (rs *rangeTombstones) covers(key string, ver version, now int64) bool {
+	rs.mux.RLock()
+	defer rs.mux.RUnlock()
+
+	for _, r := range rs.ranges {
+		if now < r.Deleted && r.covers(key, ver) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the tombstones which are not removable yet
+func (rs *rangeTombstones) list(now int64) []rangeTombstone {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	rs.removeExpired(now)
+	if len(rs.ranges) == 0 {
+		return nil
+	}
+	ranges := make([]rangeTombstone, 0, len(rs.ranges))
+	for _, r := range rs.ranges {
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// removeExpired removes the removable tombstones, the lock must be held by the caller
+func (rs *rangeTombstones) removeExpired(now int64) {
+	for prefix, r := range rs.ranges {
+		if now >= r.Deleted {
+			delete(rs.ranges, prefix)
+		}
+	}
+}
+
+// mergeRangeTombstones merges the given range tombstones into the existing ones,
+// keeping the newest tombstone of every prefix
+func mergeRangeTombstones(existing, other []rangeTombstone) []rangeTombstone {
+	for _, r := range other {
+		found := false
+		for i, e := range existing {
+			if e.Prefix != r.Prefix {
+				continue
+			}
+			found = true
+			if r.Version.compare(e.Version) > 0 {
+				existing[i] = r
+			}
+			break
+		}
+		if !found {
+			existing = append(existing, r)
+		}
+	}
+	return existing
+}
+
+// deleteRange applies the given range tombstone to the cache.
+// It returns the deleted keys, not including the tombstones,
+// and false if the range tombstone is already known.
+func (c *cache) deleteRange(r rangeTombstone) ([]string, bool) {
+	now := time.Now().UnixNano()
+	if !c.ranges.add(r, now) {
+		return nil, false
+	}
+
+	var deleted []string
+	for _, sh := range c.shards {
+		sh.mux.Lock()
+		for _, key := range sh.keys() {
+			if !strings.HasPrefix(key, r.Prefix) {
+				continue
+			}
+			val, ok := sh.peek(key)
+			if !ok || !r.covers(key, val.version) {
+				continue
+			}
+			sh.remove(key)
+			if val.deleted <= 0 && !val.removable(now) {
+				deleted = append(deleted, key)
+			}
+		}
+		sh.mux.Unlock()
+	}
+	return deleted, true
+}
+
+// notifyRange sends the delete events of the keys deleted by the given range tombstone
+func (c *cache) notifyRange(r rangeTombstone, keys []string) {
+	e := entry{Deleted: r.Deleted, Version: r.Version}
+	for _, key := range keys {
+		c.notify(key, e, r.Version.Origin)
+	}
+}
+
+// mergeRanges applies the range tombstones of the received message,
+// and returns the ones which are new to this cache
+func (c *cache) mergeRanges(msg *message) []rangeTombstone {
+	var ranges []rangeTombstone
+	for _, r := range msg.Ranges {
+		keys, ok := c.deleteRange(r)
+		if !ok {
+			continue
+		}
+		ranges = append(ranges, r)
+
+		if c.onRemoteUpdate != nil {
+			for _, key := range keys {
+				c.onRemoteUpdate(key, uint64(r.Version.Origin))
+			}
+		}
+		c.notifyRange(r, keys)
+	}
+	return ranges
+}
+
+// DeleteRange deletes the keys which have the given prefix
+// and broadcast the range tombstone
+func (p *peer) DeleteRange(ctx context.Context, prefix string, deleteTimestamp int64) error {
+	if p.cc.wireOpts.legacyJSON {
+		return errRangeLegacyEncoding
+	}
+	return p.do(ctx, func() {
+		r := rangeTombstone{
+			Prefix:  prefix,
+			Deleted: deleteTimestamp,
+			Version: p.newVersion(),
+		}
+		keys, _ := p.cc.deleteRange(r)
+		atomic.AddUint64(&p.stats.deletes, uint64(len(keys)))
+		p.cc.notifyRange(r, keys)
+
+		m := p.cc.newMessage(0)
+		m.Ranges = []rangeTombstone{r}
+
+		p.broadcast(m)
+	})
+}
@@ -0,0 +1,324 @@
+package bcache
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultShardCount = 1
+)
+
+// shard is a part of the cache which has its own store and lock,
+// so access to the different shards don't contend with each other.
+// The store decides which key to evict, according to the eviction policy.
+type shard struct {
+	// mux serializes the read-modify-write changes of the shard,
+	// e.g.: conditional set and merge of the received data.
+	// Plain get and set only rely on the lock of the store.
+	mux sync.Mutex
+
+	lock    sync.Mutex // protects the fields below
+	store   store
+	bytes   int64    // total size of the keys and values
+	digest  []uint64 // hash of every anti entropy bucket, nil if the anti entropy is disabled
+	evicted []evictedValue
+
+	index  int         // index of the shard
+	budget *byteBudget // size limit shared by all of the shards
+
+	// callbacks of the events,
+	// always called without holding the locks
+	onEvict  func(key string, val []byte)
+	onExpire func(key string, val []byte)
+	metrics  Metrics
+
+	// number of the evicted and expired keys
+	evictions uint64
+	expired   uint64
+}
+
+// evictedValue is the value evicted by the store,
+// kept until the evict callback could be called
+type evictedValue struct {
+	key string
+	val value
+}
+
+// newShards creates the shards for the given total number of keys and bytes.
+// The number of keys is divided evenly between the shards, and number of the shards
+// is reduced when there are more shards than the keys.
+// The size in bytes is limited for all of the shards together.
+//
+// MaxKeys <= 0 is only allowed when the size is limited by MaxBytes.
+func newShards(cfg Config) ([]*shard, error) {
+	var (
+		maxKeys    = cfg.MaxKeys
+		maxBytes   = cfg.MaxBytes
+		shardCount = cfg.ShardCount
+	)
+
+	if shardCount <= 0 {
+		shardCount = defaultShardCount
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = &nopMetrics{}
+	}
+	if maxKeys > 0 && shardCount > maxKeys {
+		shardCount = maxKeys
+	}
+
+	size := (maxKeys + shardCount - 1) / shardCount
+	if maxKeys <= 0 && maxBytes > 0 {
+		size = math.MaxInt32
+	}
+
+	var (
+		shards = make([]*shard, shardCount)
+		budget = &byteBudget{max: maxBytes, shards: shards}
+	)
+	for i := range shards {
+		sh := &shard{
+			index:    i,
+			budget:   budget,
+			onEvict:  cfg.OnEvict,
+			onExpire: cfg.OnExpire,
+			metrics:  cfg.Metrics,
+		}
+
+		st, err := newStore(cfg.EvictionPolicy, size, sh.evict)
+		if err != nil {
+			return nil, err
+		}
+		sh.store = st
+		shards[i] = sh
+	}
+	return shards, nil
+}
+
+// evict is called by the store for every evicted key,
+// the lock is already held by the caller.
+func (s *shard) evict(key string, val value) {
+	s.removed(key, val)
+	s.metrics.Evicted()
+	s.metrics.KeysChanged(-1)
+	atomic.AddUint64(&s.evictions, 1)
+
+	// tombstone is not a value
+	if s.onEvict != nil && val.deleted <= 0 {
+		s.evicted = append(s.evicted, evictedValue{key: key, val: val})
+	}
+}
+
+// add adds or replaces the value of the given key,
+// and evicts the keys chosen by the store if the shard exceeds its size.
+// The keys of all of the shards are evicted if the cache exceeds the size in bytes.
+//
+// The value which is bigger than the size in bytes of the whole cache is not added,
+// and the existing value of the key is removed, nothing else is evicted.
+func (s *shard) add(key string, val value) {
+	size := valueSize(key, val)
+	if s.budget.max > 0 && size > s.budget.max {
+		s.remove(key)
+		return
+	}
+
+	s.lock.Lock()
+
+	if old, ok := s.store.Peek(key); ok {
+		// replaced value is not reported to evict
+		s.removed(key, old)
+	} else {
+		s.metrics.KeysChanged(1)
+	}
+	s.store.Add(key, val)
+	s.added(key, val)
+
+	evicted := s.evicted
+	s.evicted = nil
+	s.lock.Unlock()
+
+	for _, ev := range evicted {
+		s.onEvict(ev.key, ev.val.value)
+	}
+
+	s.budget.fit(s.index)
+}
+
+// evictOldest evicts the key chosen by the store.
+// It returns false if the shard is empty.
+func (s *shard) evictOldest() bool {
+	s.lock.Lock()
+
+	key, val, ok := s.store.RemoveOldest()
+	if ok {
+		s.evict(key, val)
+	}
+
+	evicted := s.evicted
+	s.evicted = nil
+	s.lock.Unlock()
+
+	for _, ev := range evicted {
+		s.onEvict(ev.key, ev.val.value)
+	}
+	return ok
+}
+
+// added adds the value to the size and the digest of the shard,
+// the lock must be held by the caller
+func (s *shard) added(key string, val value) {
+	s.addBytes(valueSize(key, val))
+	s.hash(key, val)
+}
+
+// removed removes the value from the size and the digest of the shard,
+// the lock must be held by the caller
+func (s *shard) removed(key string, val value) {
+	s.addBytes(-valueSize(key, val))
+	s.hash(key, val)
+}
+
+// addBytes adds the given size to the size of the shard and the cache,
+// the lock must be held by the caller
+func (s *shard) addBytes(size int64) {
+	s.bytes += size
+	atomic.AddInt64(&s.budget.used, size)
+}
+
+// hash toggles the value in the digest of its bucket,
+// the lock must be held by the caller
+func (s *shard) hash(key string, val value) {
+	if s.digest != nil {
+		s.digest[bucketOf(key, len(s.digest))] ^= entryHash(key, val.entry())
+	}
+}
+
+// digestInto merges the digest of the shard into the given digest
+func (s *shard) digestInto(digest []uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, h := range s.digest {
+		digest[i] ^= h
+	}
+}
+
+func (s *shard) get(key string) (value, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.store.Get(key)
+}
+
+// peek gets the value of the given key without updating the recentness
+func (s *shard) peek(key string) (value, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.store.Peek(key)
+}
+
+func (s *shard) remove(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if val, ok := s.store.Remove(key); ok {
+		s.removed(key, val)
+		s.metrics.KeysChanged(-1)
+	}
+}
+
+// expire removes the given key if it is expired or deleted at the given time.
+// It returns true if the key has been removed.
+func (s *shard) expire(key string, now int64) bool {
+	s.lock.Lock()
+	val, ok := s.store.Peek(key)
+	if !ok || !val.removable(now) {
+		s.lock.Unlock()
+		return false
+	}
+	s.store.Remove(key)
+	s.removed(key, val)
+	s.lock.Unlock()
+	s.metrics.KeysChanged(-1)
+	atomic.AddUint64(&s.expired, 1)
+
+	// tombstone is not a value
+	if s.onExpire != nil && val.deleted <= 0 {
+		s.onExpire(key, val.value)
+	}
+	return true
+}
+
+// keys returns the keys of the shard
+func (s *shard) keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.store.Keys()
+}
+
+func (s *shard) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.store.Len()
+}
+
+// usedBytes returns total size of the keys and values in the shard
+func (s *shard) usedBytes() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bytes
+}
+
+// byteBudget is the size limit in bytes shared by all of the shards
+type byteBudget struct {
+	max    int64 // 0 means unlimited
+	used   int64 // total size of the shards, accessed atomically
+	shards []*shard
+}
+
+// fit evicts the keys until the cache fits the size limit.
+//
+// One key is evicted from every shard in turn, starting from the shard after the given one,
+// which is the shard of the newly added key, so its own shard is evicted last.
+// The evicted keys are chosen by the store of every shard,
+// so they are only approximately the ones the EvictionPolicy would choose for the whole cache.
+func (b *byteBudget) fit(from int) {
+	n := len(b.shards)
+	for b.max > 0 && atomic.LoadInt64(&b.used) > b.max {
+		var evicted bool
+		for i := 1; i <= n && atomic.LoadInt64(&b.used) > b.max; i++ {
+			if b.shards[(from+i)%n].evictOldest() {
+				evicted = true
+			}
+		}
+		if !evicted {
+			return
+		}
+	}
+}
+
+// valueSize returns the size of the key and value which counted
+// against the bytes limit
+func valueSize(key string, val value) int64 {
+	return int64(len(key) + len(val.value))
+}
+
+// shardIndex returns index of the shard of the given key.
+// It is inlined fnv32a, to avoid allocation in the hot path.
+func shardIndex(key string, numShards int) int {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	h := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime32
+	}
+	return int(h % uint32(numShards))
+}
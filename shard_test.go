@@ -0,0 +1,270 @@
+package bcache
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestNewShards(t *testing.T) {
+	testCases := []struct {
+		name       string
+		maxKeys    int
+		shardCount int
+		numShards  int
+		shardSize  int
+	}{
+		{
+			name:      "default",
+			maxKeys:   1000,
+			numShards: 1,
+			shardSize: 1000,
+		},
+		{
+			name:       "sharded",
+			maxKeys:    1000,
+			shardCount: 16,
+			numShards:  16,
+			shardSize:  63,
+		},
+		{
+			name:       "more shards than keys",
+			maxKeys:    4,
+			shardCount: 16,
+			numShards:  4,
+			shardSize:  1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shards, err := newShards(Config{MaxKeys: tc.maxKeys, ShardCount: tc.shardCount})
+			require.NoError(t, err)
+			require.Len(t, shards, tc.numShards)
+
+			// fill the shard more than its size
+			sh := shards[0]
+			for i := 0; i < tc.shardSize+10; i++ {
+				sh.add(strconv.Itoa(i), value{})
+			}
+			require.Equal(t, tc.shardSize, sh.len())
+		})
+	}
+
+	_, err := newShards(Config{ShardCount: 16})
+	require.Error(t, err)
+}
+
+func TestShardMaxBytes(t *testing.T) {
+	shards, err := newShards(Config{MaxBytes: 100, ShardCount: 1})
+	require.NoError(t, err)
+	sh := shards[0]
+
+	// key and value sizes are counted
+	sh.add("key1", value{value: make([]byte, 36)})
+	sh.add("key2", value{value: make([]byte, 36)})
+	require.Equal(t, int64(80), sh.usedBytes())
+
+	// replaced value
+	sh.add("key2", value{value: make([]byte, 16)})
+	require.Equal(t, int64(60), sh.usedBytes())
+
+	// least recently used key evicted to fit the budget
+	_, ok := sh.get("key1")
+	require.True(t, ok)
+	sh.add("key3", value{value: make([]byte, 46)})
+	require.Equal(t, int64(90), sh.usedBytes())
+	_, ok = sh.peek("key2")
+	require.False(t, ok)
+	_, ok = sh.peek("key1")
+	require.True(t, ok)
+
+	sh.remove("key1")
+	require.Equal(t, int64(50), sh.usedBytes())
+
+	// value bigger than the budget is not kept, and nothing else is evicted
+	sh.add("key4", value{value: make([]byte, 200)})
+	require.Equal(t, int64(50), sh.usedBytes())
+	require.Equal(t, 1, sh.len())
+
+	// the replaced value is removed
+	sh.add("key3", value{value: make([]byte, 200)})
+	require.Equal(t, int64(0), sh.usedBytes())
+	require.Equal(t, 0, sh.len())
+}
+
+// value bigger than the share of a single shard
+func TestShardMaxBytesShared(t *testing.T) {
+	const (
+		maxBytes  = 16 << 20
+		valueSize = 2 << 20
+	)
+
+	shards, err := newShards(Config{MaxBytes: maxBytes, ShardCount: 16})
+	require.NoError(t, err)
+	require.Len(t, shards, 16)
+
+	add := func(key string, size int) {
+		shards[shardIndex(key, len(shards))].add(key, value{value: make([]byte, size)})
+	}
+	exists := func(key string) bool {
+		_, ok := shards[shardIndex(key, len(shards))].peek(key)
+		return ok
+	}
+	usedBytes := func() int64 {
+		var n int64
+		for _, sh := range shards {
+			n += sh.usedBytes()
+		}
+		return n
+	}
+
+	for i := 0; i < 100; i++ {
+		add(fmt.Sprintf("small-%d", i), 10)
+	}
+	add("big-0", valueSize)
+	require.True(t, exists("big-0"))
+	for i := 0; i < 100; i++ {
+		require.True(t, exists(fmt.Sprintf("small-%d", i)))
+	}
+
+	// the keys of the other shards are evicted to fit the budget
+	for i := 1; i < 10; i++ {
+		add(fmt.Sprintf("big-%d", i), valueSize)
+		require.True(t, exists(fmt.Sprintf("big-%d", i)))
+		require.True(t, usedBytes() <= maxBytes)
+	}
+}
+
+func TestShardMaxKeysAndBytes(t *testing.T) {
+	shards, err := newShards(Config{MaxKeys: 2, MaxBytes: 1000, ShardCount: 1})
+	require.NoError(t, err)
+	sh := shards[0]
+
+	for i := 0; i < 3; i++ {
+		sh.add(strconv.Itoa(i), value{value: make([]byte, 9)})
+	}
+	require.Equal(t, 2, sh.len())
+	require.Equal(t, int64(20), sh.usedBytes())
+}
+
+func TestShardCallbacks(t *testing.T) {
+	var (
+		evicted = make(map[string]string)
+		expired = make(map[string]string)
+		sh      *shard
+	)
+
+	shards, err := newShards(Config{
+		MaxKeys:    2,
+		ShardCount: 1,
+		OnEvict: func(key string, val []byte) {
+			// called without holding the lock
+			_, ok := sh.peek(key)
+			require.False(t, ok)
+			evicted[key] = string(val)
+		},
+		OnExpire: func(key string, val []byte) {
+			_, ok := sh.peek(key)
+			require.False(t, ok)
+			expired[key] = string(val)
+		},
+	})
+	require.NoError(t, err)
+	sh = shards[0]
+
+	now := time.Now().UnixNano()
+
+	// tombstone is not reported
+	sh.add("deleted", value{value: []byte("val"), expired: now + 10, deleted: now - 1})
+	require.True(t, sh.expire("deleted", now))
+	sh.add("deleted", value{value: []byte("val"), expired: now + 10, deleted: now - 1})
+
+	sh.add("key1", value{value: []byte("val1"), expired: now - 1})
+	sh.add("key2", value{value: []byte("val2"), expired: now + 10})
+	sh.add("key3", value{value: []byte("val3"), expired: now + 10})
+	require.Equal(t, map[string]string{"key1": "val1"}, evicted)
+
+	require.False(t, sh.expire("key2", now))
+	require.True(t, sh.expire("key2", now+10))
+	require.Equal(t, map[string]string{"key2": "val2"}, expired)
+	require.Empty(t, expired["deleted"])
+}
+
+func TestShardIndex(t *testing.T) {
+	const (
+		numShards = 16
+		numKeys   = 10000
+	)
+
+	counts := make([]int, numShards)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		idx := shardIndex(key, numShards)
+		require.Equal(t, idx, shardIndex(key, numShards))
+		counts[idx]++
+	}
+
+	// keys should be distributed evenly
+	for _, count := range counts {
+		require.InDelta(t, numKeys/numShards, count, numKeys/numShards/4)
+	}
+}
+
+func TestCacheShards(t *testing.T) {
+	const numKeys = 500
+
+	cc, err := newCache(mesh.PeerName(1), Config{MaxKeys: 1000, ShardCount: 8})
+	require.NoError(t, err)
+	require.Len(t, cc.shards, 8)
+
+	expired := time.Now().Add(time.Hour).UnixNano()
+	entries := make(map[string]entry, numKeys)
+	for i := 0; i < numKeys; i++ {
+		entries[fmt.Sprintf("key-%d", i)] = entry{
+			Val:     []byte(fmt.Sprintf("val-%d", i)),
+			Expired: expired,
+		}
+	}
+
+	// merged into the shards of the keys
+	cc.mergeComplete(newMessageFromEntries(mesh.PeerName(2), entries))
+	require.Equal(t, numKeys, cc.len())
+	for _, sh := range cc.shards {
+		require.NotZero(t, sh.len())
+	}
+
+	// and collected back from all of the shards
+	require.Equal(t, entries, cc.Messages().Entries)
+}
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	const numKeys = 10000
+
+	for _, shardCount := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards-%d", shardCount), func(b *testing.B) {
+			cc, err := newCache(mesh.PeerName(1), Config{MaxKeys: numKeys, ShardCount: shardCount})
+			require.NoError(b, err)
+
+			expired := time.Now().Add(time.Hour).UnixNano()
+			keys := make([]string, numKeys)
+			for i := range keys {
+				keys[i] = strconv.Itoa(i)
+				cc.Set(keys[i], entry{Val: []byte("val"), Expired: expired})
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					cc.Get(keys[i%numKeys])
+					i++
+				}
+			})
+		})
+	}
+}
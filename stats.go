@@ -0,0 +1,80 @@
+package bcache
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the counters of a Bcache,
+// the counters start from zero when the Bcache is created.
+type Stats struct {
+	// Hits and Misses are number of the Get which found and not found the key
+	Hits   uint64
+	Misses uint64
+
+	// Sets and Deletes are number of the keys set and deleted by this peer,
+	// the changes received from the other peers are not counted
+	Sets    uint64
+	Deletes uint64
+
+	// Evictions is number of the keys evicted because the cache is full
+	Evictions uint64
+
+	// Expired is number of the expired values and tombstones removed from the cache
+	Expired uint64
+
+	// FillerCalls and FillerErrors are number of the filler calls of GetWithFiller,
+	// and number of them which returned error
+	FillerCalls  uint64
+	FillerErrors uint64
+
+	// FillerSharedWaits is number of the GetWithFiller which didn't call the filler,
+	// but waited for the result of the same key filled by another caller
+	FillerSharedWaits uint64
+
+	// number and size of the gossip messages received and sent
+	GossipMessagesIn  uint64
+	GossipBytesIn     uint64
+	GossipMessagesOut uint64
+	GossipBytesOut    uint64
+
+	// Keys is current number of the keys in the cache,
+	// including the expired and deleted ones which are not removed yet
+	Keys int
+
+	// Bytes is current total size of the keys and values in the cache
+	Bytes int64
+}
+
+// cacheStats is the counters of the cache,
+// they are shared with the messages created by the cache
+type cacheStats struct {
+	hits              uint64
+	misses            uint64
+	gossipMessagesIn  uint64
+	gossipBytesIn     uint64
+	gossipMessagesOut uint64
+	gossipBytesOut    uint64
+}
+
+func (cs *cacheStats) received(size int) {
+	atomic.AddUint64(&cs.gossipMessagesIn, 1)
+	atomic.AddUint64(&cs.gossipBytesIn, uint64(size))
+}
+
+func (cs *cacheStats) sent(size int) {
+	atomic.AddUint64(&cs.gossipMessagesOut, 1)
+	atomic.AddUint64(&cs.gossipBytesOut, uint64(size))
+}
+
+// peerStats is the counters of the local changes made by the peer
+type peerStats struct {
+	sets    uint64
+	deletes uint64
+}
+
+// fillerStats is the counters of GetWithFiller
+type fillerStats struct {
+	calls       uint64
+	errors      uint64
+	sharedWaits uint64
+}
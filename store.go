@@ -0,0 +1,223 @@
+package bcache
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	// size of the LRU list of the stores,
+	// the actual size is managed by the stores
+	maxListSize = int(^uint(0) >> 1)
+)
+
+var (
+	errInvalidStoreSize = errors.New("must provide a positive size")
+)
+
+// store keeps the values of a shard and decides which key to evict
+// when it is full.
+//
+// It is not safe for concurrent use, the shard protects it by its lock.
+type store interface {
+	// Add adds or replaces the value of the given key.
+	// Replacing the value is not an access, e.g.: it doesn't promote the key
+	// to the frequently used keys, because most of them come from the other peers.
+	// The evict callback is called for every key evicted to make room for it.
+	Add(key string, val value)
+
+	// Get gets the value of the given key and records the access
+	Get(key string) (value, bool)
+
+	// Peek gets the value of the given key without recording the access
+	Peek(key string) (value, bool)
+
+	// Remove removes the given key and returns its value
+	Remove(key string) (value, bool)
+
+	// RemoveOldest removes the key which would be evicted next
+	RemoveOldest() (string, value, bool)
+
+	// Keys returns all of the keys in the store
+	Keys() []string
+
+	// Len returns number of the keys in the store
+	Len() int
+}
+
+// evictFunc is called for every key evicted by the store because it is full
+type evictFunc func(key string, val value)
+
+// newStore creates store of the given eviction policy
+// which could hold up to size keys.
+func newStore(policy EvictionPolicy, size int, onEvict evictFunc) (store, error) {
+	if size <= 0 {
+		return nil, errInvalidStoreSize
+	}
+
+	switch policy {
+	case "", EvictLRU:
+		return newLRUStore(size, onEvict), nil
+	case EvictTwoQueue:
+		return newTwoQueueStore(size, onEvict), nil
+	case EvictARC:
+		return newARCStore(size, onEvict), nil
+	case EvictTinyLFU:
+		return newTinyLFUStore(size, onEvict), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy: %v", policy)
+}
+
+// lruStore is store which evicts the least recently used key
+type lruStore struct {
+	size    int
+	lru     *list
+	onEvict evictFunc
+}
+
+func newLRUStore(size int, onEvict evictFunc) *lruStore {
+	return &lruStore{
+		size:    size,
+		lru:     newList(),
+		onEvict: onEvict,
+	}
+}
+
+func (s *lruStore) Add(key string, val value) {
+	if !s.lru.Contains(key) && s.lru.Len() >= s.size {
+		k, v, _ := s.lru.RemoveOldest()
+		s.onEvict(k, v)
+	}
+	s.lru.Add(key, val)
+}
+
+func (s *lruStore) Get(key string) (value, bool) {
+	return s.lru.Get(key)
+}
+
+func (s *lruStore) Peek(key string) (value, bool) {
+	return s.lru.Peek(key)
+}
+
+func (s *lruStore) Remove(key string) (value, bool) {
+	return s.lru.Remove(key)
+}
+
+func (s *lruStore) RemoveOldest() (string, value, bool) {
+	return s.lru.RemoveOldest()
+}
+
+func (s *lruStore) Keys() []string {
+	return s.lru.Keys()
+}
+
+func (s *lruStore) Len() int {
+	return s.lru.Len()
+}
+
+// list is LRU list of values without size limit,
+// the building block of the stores.
+type list struct {
+	lru *simplelru.LRU
+}
+
+func newList() *list {
+	lru, _ := simplelru.NewLRU(maxListSize, nil)
+	return &list{lru: lru}
+}
+
+func (l *list) Add(key string, val value) {
+	l.lru.Add(key, val)
+}
+
+func (l *list) Get(key string) (value, bool) {
+	val, ok := l.lru.Get(key)
+	if !ok {
+		return value{}, false
+	}
+	return val.(value), true
+}
+
+func (l *list) Peek(key string) (value, bool) {
+	val, ok := l.lru.Peek(key)
+	if !ok {
+		return value{}, false
+	}
+	return val.(value), true
+}
+
+func (l *list) Contains(key string) bool {
+	return l.lru.Contains(key)
+}
+
+func (l *list) Remove(key string) (value, bool) {
+	val, ok := l.Peek(key)
+	if ok {
+		l.lru.Remove(key)
+	}
+	return val, ok
+}
+
+func (l *list) RemoveOldest() (string, value, bool) {
+	key, val, ok := l.lru.RemoveOldest()
+	if !ok {
+		return "", value{}, false
+	}
+	return key.(string), val.(value), true
+}
+
+func (l *list) Oldest() (string, bool) {
+	key, _, ok := l.lru.GetOldest()
+	if !ok {
+		return "", false
+	}
+	return key.(string), true
+}
+
+func (l *list) Keys() []string {
+	keys := make([]string, 0, l.lru.Len())
+	for _, k := range l.lru.Keys() {
+		keys = append(keys, k.(string))
+	}
+	return keys
+}
+
+func (l *list) Len() int {
+	return l.lru.Len()
+}
+
+// ghostList is LRU list of recently evicted keys, without the values.
+// It is used by the adaptive policies to remember the history.
+type ghostList struct {
+	lru *simplelru.LRU
+}
+
+func newGhostList(size int) *ghostList {
+	if size <= 0 {
+		size = 1
+	}
+	lru, _ := simplelru.NewLRU(size, nil)
+	return &ghostList{lru: lru}
+}
+
+func (g *ghostList) Add(key string) {
+	g.lru.Add(key, nil)
+}
+
+func (g *ghostList) Contains(key string) bool {
+	return g.lru.Contains(key)
+}
+
+func (g *ghostList) Remove(key string) {
+	g.lru.Remove(key)
+}
+
+func (g *ghostList) RemoveOldest() {
+	g.lru.RemoveOldest()
+}
+
+func (g *ghostList) Len() int {
+	return g.lru.Len()
+}
@@ -0,0 +1,252 @@
+package bcache
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testPolicies = []EvictionPolicy{EvictLRU, EvictTwoQueue, EvictARC, EvictTinyLFU}
+
+func TestNewStore(t *testing.T) {
+	st, err := newStore("", 10, func(string, value) {})
+	require.NoError(t, err)
+	require.IsType(t, &lruStore{}, st)
+
+	_, err = newStore(EvictLRU, 0, func(string, value) {})
+	require.Error(t, err)
+
+	_, err = newStore("unknown", 10, func(string, value) {})
+	require.Error(t, err)
+}
+
+func TestStore(t *testing.T) {
+	const size = 100
+
+	for _, policy := range testPolicies {
+		t.Run(string(policy), func(t *testing.T) {
+			evicted := make(map[string]value)
+			st, err := newStore(policy, size, func(key string, val value) {
+				evicted[key] = val
+			})
+			require.NoError(t, err)
+
+			// get, peek, and replace
+			st.Add("key", value{value: []byte("val1")})
+			st.Add("key", value{value: []byte("val2")})
+			val, ok := st.Get("key")
+			require.True(t, ok)
+			require.Equal(t, []byte("val2"), val.value)
+			val, ok = st.Peek("key")
+			require.True(t, ok)
+			require.Equal(t, []byte("val2"), val.value)
+			require.Equal(t, 1, st.Len())
+			require.Empty(t, evicted)
+
+			// remove
+			val, ok = st.Remove("key")
+			require.True(t, ok)
+			require.Equal(t, []byte("val2"), val.value)
+			_, ok = st.Remove("key")
+			require.False(t, ok)
+			_, ok = st.Get("key")
+			require.False(t, ok)
+			require.Equal(t, 0, st.Len())
+
+			// never exceeds the size, and report every eviction
+			const numKeys = 3 * size
+			for i := 0; i < numKeys; i++ {
+				key := strconv.Itoa(i)
+				st.Add(key, value{value: []byte(key)})
+				st.Get(strconv.Itoa(rand.Intn(i + 1)))
+				require.True(t, st.Len() <= size)
+			}
+			require.Equal(t, size, st.Len())
+			require.Len(t, evicted, numKeys-size)
+
+			keys := st.Keys()
+			require.Len(t, keys, size)
+			for _, key := range keys {
+				require.NotContains(t, evicted, key)
+				val, ok := st.Peek(key)
+				require.True(t, ok)
+				require.Equal(t, key, string(val.value))
+			}
+			for key, val := range evicted {
+				require.Equal(t, key, string(val.value))
+			}
+
+			// remove all of the keys
+			var removed []string
+			for {
+				key, _, ok := st.RemoveOldest()
+				if !ok {
+					break
+				}
+				removed = append(removed, key)
+			}
+			sort.Strings(keys)
+			sort.Strings(removed)
+			require.Equal(t, keys, removed)
+			require.Equal(t, 0, st.Len())
+		})
+	}
+}
+
+// frequently used keys survive a scan of new keys
+func TestStoreScanResistance(t *testing.T) {
+	const (
+		size    = 100
+		numHot  = 20
+		numScan = 1000
+	)
+
+	for _, policy := range []EvictionPolicy{EvictTwoQueue, EvictARC, EvictTinyLFU} {
+		t.Run(string(policy), func(t *testing.T) {
+			st, err := newStore(policy, size, func(string, value) {})
+			require.NoError(t, err)
+
+			for i := 0; i < numHot; i++ {
+				key := fmt.Sprintf("hot-%d", i)
+				st.Add(key, value{})
+				for j := 0; j < 3; j++ {
+					st.Get(key)
+				}
+			}
+
+			for i := 0; i < numScan; i++ {
+				st.Add(fmt.Sprintf("scan-%d", i), value{})
+			}
+
+			for i := 0; i < numHot; i++ {
+				_, ok := st.Peek(fmt.Sprintf("hot-%d", i))
+				require.True(t, ok)
+			}
+		})
+	}
+}
+
+// keys which are only updated, e.g.: by the received data, don't evict the frequently used keys
+func TestStoreUpdateNotAccess(t *testing.T) {
+	const (
+		size    = 100
+		numHot  = 20
+		numScan = 1000
+	)
+
+	for _, policy := range []EvictionPolicy{EvictTwoQueue, EvictARC, EvictTinyLFU} {
+		t.Run(string(policy), func(t *testing.T) {
+			st, err := newStore(policy, size, func(string, value) {})
+			require.NoError(t, err)
+
+			for i := 0; i < numHot; i++ {
+				key := fmt.Sprintf("hot-%d", i)
+				st.Add(key, value{})
+				for j := 0; j < 3; j++ {
+					st.Get(key)
+				}
+			}
+
+			for i := 0; i < numScan; i++ {
+				key := fmt.Sprintf("scan-%d", i)
+				st.Add(key, value{value: []byte("val1")})
+				st.Add(key, value{value: []byte("val2")})
+			}
+
+			for i := 0; i < numHot; i++ {
+				_, ok := st.Peek(fmt.Sprintf("hot-%d", i))
+				require.True(t, ok)
+			}
+		})
+	}
+}
+
+func TestCountMinSketch(t *testing.T) {
+	sketch := newCountMinSketch(100)
+
+	for i := 0; i < 5; i++ {
+		sketch.Increment(hashKey("key"))
+	}
+	require.Equal(t, uint8(5), sketch.Estimate(hashKey("key")))
+	require.Equal(t, uint8(0), sketch.Estimate(hashKey("other")))
+
+	// saturated
+	for i := 0; i < 2*sketchMaxCount; i++ {
+		sketch.Increment(hashKey("key"))
+	}
+	require.Equal(t, uint8(sketchMaxCount), sketch.Estimate(hashKey("key")))
+
+	// aged
+	sketch.reset()
+	require.Equal(t, uint8(sketchMaxCount/2), sketch.Estimate(hashKey("key")))
+}
+
+// BenchmarkStoreHitRatio compares the hit ratio of the eviction policies,
+// the cache is filled on every miss.
+func BenchmarkStoreHitRatio(b *testing.B) {
+	const (
+		size    = 1000
+		numKeys = 100 * size
+	)
+
+	workloads := []struct {
+		name string
+		next func(r *rand.Rand) func() int
+	}{
+		{
+			name: "zipf",
+			next: func(r *rand.Rand) func() int {
+				zipf := rand.NewZipf(r, 1.01, 1, numKeys-1)
+				return func() int {
+					return int(zipf.Uint64())
+				}
+			},
+		},
+		{
+			// zipf access mixed with sequential scan of the keys
+			// which are never accessed again
+			name: "zipf-scan",
+			next: func(r *rand.Rand) func() int {
+				var (
+					zipf = rand.NewZipf(r, 1.01, 1, numKeys-1)
+					scan = numKeys
+				)
+				return func() int {
+					if r.Intn(3) == 0 {
+						scan++
+						return scan
+					}
+					return int(zipf.Uint64())
+				}
+			},
+		},
+	}
+
+	for _, workload := range workloads {
+		for _, policy := range testPolicies {
+			b.Run(fmt.Sprintf("%v/%v", workload.name, policy), func(b *testing.B) {
+				st, err := newStore(policy, size, func(string, value) {})
+				require.NoError(b, err)
+
+				var (
+					next = workload.next(rand.New(rand.NewSource(1)))
+					hits int
+				)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					key := strconv.Itoa(next())
+					if _, ok := st.Get(key); ok {
+						hits++
+						continue
+					}
+					st.Add(key, value{})
+				}
+				b.ReportMetric(100*float64(hits)/float64(b.N), "hit%")
+			})
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package bcache
+
+const (
+	// percentage of the store size used by the window list
+	tinyLFUWindowPercent = 1
+
+	// percentage of the main size used by the protected list
+	tinyLFUProtectedPercent = 80
+
+	// number of counters in every row of the frequency sketch per key,
+	// to keep the collisions low
+	tinyLFUSketchRatio = 8
+
+	// max number of counters in every row of the frequency sketch
+	tinyLFUMaxSketchWidth = 1 << 16
+)
+
+// tinyLFUStore is store using the W-TinyLFU eviction policy.
+//
+// New keys enter a small LRU window. The key evicted from the window is only
+// admitted to the main segmented LRU if it is used more frequently than the key
+// which would be evicted from the main one, the frequencies are estimated
+// by a count-min sketch which remembers the keys even after they are evicted.
+// It keeps the frequently used keys under scans and one-hit wonders.
+type tinyLFUStore struct {
+	windowSize    int
+	mainSize      int
+	protectedSize int
+
+	window    *list
+	probation *list // main keys used once
+	protected *list // main keys used more than once
+	sketch    *countMinSketch
+
+	onEvict evictFunc
+}
+
+func newTinyLFUStore(size int, onEvict evictFunc) *tinyLFUStore {
+	windowSize := size * tinyLFUWindowPercent / 100
+	if windowSize < 1 {
+		windowSize = 1
+	}
+	mainSize := size - windowSize
+
+	return &tinyLFUStore{
+		windowSize:    windowSize,
+		mainSize:      mainSize,
+		protectedSize: mainSize * tinyLFUProtectedPercent / 100,
+		window:        newList(),
+		probation:     newList(),
+		protected:     newList(),
+		sketch:        newCountMinSketch(size),
+		onEvict:       onEvict,
+	}
+}
+
+func (s *tinyLFUStore) Add(key string, val value) {
+	switch {
+	case s.window.Contains(key):
+		s.window.Add(key, val)
+		return
+	case s.probation.Contains(key):
+		s.probation.Add(key, val)
+		return
+	case s.protected.Contains(key):
+		s.protected.Add(key, val)
+		return
+	}
+
+	// new key
+	s.sketch.Increment(hashKey(key))
+	s.window.Add(key, val)
+	if s.window.Len() > s.windowSize {
+		candidate, val, _ := s.window.RemoveOldest()
+		s.admit(candidate, val)
+	}
+}
+
+// admit moves the key evicted from the window to the main lists
+// if it is used more frequently than the victim of the main lists
+func (s *tinyLFUStore) admit(candidate string, val value) {
+	if s.probation.Len()+s.protected.Len() < s.mainSize {
+		s.probation.Add(candidate, val)
+		return
+	}
+
+	victims := s.probation
+	if victims.Len() == 0 {
+		victims = s.protected
+	}
+	victim, ok := victims.Oldest()
+	if !ok || s.sketch.Estimate(hashKey(candidate)) <= s.sketch.Estimate(hashKey(victim)) {
+		s.onEvict(candidate, val)
+		return
+	}
+
+	victimVal, _ := victims.Remove(victim)
+	s.onEvict(victim, victimVal)
+	s.probation.Add(candidate, val)
+}
+
+func (s *tinyLFUStore) Get(key string) (value, bool) {
+	s.sketch.Increment(hashKey(key))
+
+	if val, ok := s.window.Get(key); ok {
+		return val, true
+	}
+	if val, ok := s.protected.Get(key); ok {
+		return val, true
+	}
+
+	// used more than once, promote it to the protected list
+	val, ok := s.probation.Remove(key)
+	if !ok {
+		return value{}, false
+	}
+	s.protected.Add(key, val)
+	if s.protected.Len() > s.protectedSize {
+		k, v, _ := s.protected.RemoveOldest()
+		s.probation.Add(k, v)
+	}
+	return val, true
+}
+
+func (s *tinyLFUStore) Peek(key string) (value, bool) {
+	if val, ok := s.window.Peek(key); ok {
+		return val, true
+	}
+	if val, ok := s.probation.Peek(key); ok {
+		return val, true
+	}
+	return s.protected.Peek(key)
+}
+
+func (s *tinyLFUStore) Remove(key string) (value, bool) {
+	for _, l := range []*list{s.window, s.probation, s.protected} {
+		if val, ok := l.Remove(key); ok {
+			return val, true
+		}
+	}
+	return value{}, false
+}
+
+// RemoveOldest removes the key from the probation list first,
+// because it is the list where the admission victim comes from.
+func (s *tinyLFUStore) RemoveOldest() (string, value, bool) {
+	for _, l := range []*list{s.probation, s.window, s.protected} {
+		if key, val, ok := l.RemoveOldest(); ok {
+			return key, val, true
+		}
+	}
+	return "", value{}, false
+}
+
+func (s *tinyLFUStore) Keys() []string {
+	keys := append(s.window.Keys(), s.probation.Keys()...)
+	return append(keys, s.protected.Keys()...)
+}
+
+func (s *tinyLFUStore) Len() int {
+	return s.window.Len() + s.probation.Len() + s.protected.Len()
+}
+
+const (
+	// number of rows of the count-min sketch
+	sketchDepth = 4
+
+	// max value of a counter
+	sketchMaxCount = 15
+)
+
+// countMinSketch estimates access frequency of the keys using
+// a fixed amount of memory.
+// The counters are halved periodically, so the old accesses are forgotten.
+type countMinSketch struct {
+	counters   []uint8
+	mask       uint32
+	additions  int
+	sampleSize int
+}
+
+// newCountMinSketch creates sketch for the given number of keys.
+// The counters are halved every 10 times of the number of keys accesses.
+func newCountMinSketch(size int) *countMinSketch {
+	width := 1
+	for width/tinyLFUSketchRatio < size && width < tinyLFUMaxSketchWidth {
+		width <<= 1
+	}
+	if size > width {
+		size = width
+	}
+
+	return &countMinSketch{
+		counters:   make([]uint8, sketchDepth*width),
+		mask:       uint32(width - 1),
+		sampleSize: 10 * size,
+	}
+}
+
+// Increment records an access of the given key hash
+func (c *countMinSketch) Increment(h uint64) {
+	for i := 0; i < sketchDepth; i++ {
+		idx := c.index(h, i)
+		if c.counters[idx] < sketchMaxCount {
+			c.counters[idx]++
+		}
+	}
+
+	if c.additions++; c.additions >= c.sampleSize {
+		c.reset()
+	}
+}
+
+// Estimate returns the estimated access frequency of the given key hash
+func (c *countMinSketch) Estimate(h uint64) uint8 {
+	est := uint8(sketchMaxCount)
+	for i := 0; i < sketchDepth; i++ {
+		if count := c.counters[c.index(h, i)]; count < est {
+			est = count
+		}
+	}
+	return est
+}
+
+// reset halves all of the counters
+func (c *countMinSketch) reset() {
+	for i := range c.counters {
+		c.counters[i] >>= 1
+	}
+	c.additions /= 2
+}
+
+// index returns the counter index of the given row, using double hashing
+func (c *countMinSketch) index(h uint64, row int) int {
+	h1, h2 := uint32(h), uint32(h>>32)
+	return row*int(c.mask+1) + int((h1+uint32(row)*h2)&c.mask)
+}
+
+// hashKey returns 64 bits fnv1a hash of the given key
+func hashKey(key string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+
+	h := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+	return h
+}
@@ -0,0 +1,132 @@
+package bcache
+
+const (
+	// ratio of the store size used by the recent list
+	twoQueueRecentRatio = 0.25
+
+	// ratio of the store size used by the ghost list
+	twoQueueGhostRatio = 0.50
+)
+
+// twoQueueStore is store using the 2Q eviction policy.
+//
+// New keys are kept in the recent list, and only moved to the frequent list
+// when they are accessed again. The keys evicted from the recent list are
+// remembered by the ghost list, so the key which is added again shortly after
+// the eviction goes directly to the frequent list.
+// A scan of new keys only flushes the recent list, and keeps the frequent keys.
+//
+// It follows the implementation of hashicorp/golang-lru 2Q cache,
+// with the evict callback which is not available in that package.
+type twoQueueStore struct {
+	size       int
+	recentSize int
+
+	recent   *list
+	frequent *list
+	ghost    *ghostList
+	onEvict  evictFunc
+}
+
+func newTwoQueueStore(size int, onEvict evictFunc) *twoQueueStore {
+	return &twoQueueStore{
+		size:       size,
+		recentSize: int(float64(size) * twoQueueRecentRatio),
+		recent:     newList(),
+		frequent:   newList(),
+		ghost:      newGhostList(int(float64(size) * twoQueueGhostRatio)),
+		onEvict:    onEvict,
+	}
+}
+
+func (s *twoQueueStore) Add(key string, val value) {
+	// frequently used key, update it
+	if s.frequent.Contains(key) {
+		s.frequent.Add(key, val)
+		return
+	}
+
+	// recently used key, update it.
+	// It is not an access, the key is only promoted by Get
+	if s.recent.Contains(key) {
+		s.recent.Add(key, val)
+		return
+	}
+
+	// recently evicted key, add it to the frequent list
+	if s.ghost.Contains(key) {
+		s.ensureSpace(true)
+		s.ghost.Remove(key)
+		s.frequent.Add(key, val)
+		return
+	}
+
+	// new key
+	s.ensureSpace(false)
+	s.recent.Add(key, val)
+}
+
+// ensureSpace evicts a key if the store is full
+func (s *twoQueueStore) ensureSpace(fromGhost bool) {
+	if s.recent.Len()+s.frequent.Len() < s.size {
+		return
+	}
+	if key, val, ok := s.evict(fromGhost); ok {
+		s.onEvict(key, val)
+	}
+}
+
+// evict removes a key from the recent list if it exceeds its target size,
+// otherwise from the frequent list
+func (s *twoQueueStore) evict(fromGhost bool) (string, value, bool) {
+	recentLen := s.recent.Len()
+	if recentLen > 0 && (recentLen > s.recentSize || (recentLen == s.recentSize && !fromGhost) || s.frequent.Len() == 0) {
+		key, val, ok := s.recent.RemoveOldest()
+		s.ghost.Add(key)
+		return key, val, ok
+	}
+	return s.frequent.RemoveOldest()
+}
+
+func (s *twoQueueStore) Get(key string) (value, bool) {
+	if val, ok := s.frequent.Get(key); ok {
+		return val, true
+	}
+
+	// accessed again, promote it to the frequent list
+	if val, ok := s.recent.Remove(key); ok {
+		s.frequent.Add(key, val)
+		return val, true
+	}
+	return value{}, false
+}
+
+func (s *twoQueueStore) Peek(key string) (value, bool) {
+	if val, ok := s.frequent.Peek(key); ok {
+		return val, true
+	}
+	return s.recent.Peek(key)
+}
+
+func (s *twoQueueStore) Remove(key string) (value, bool) {
+	if val, ok := s.frequent.Remove(key); ok {
+		return val, true
+	}
+	if val, ok := s.recent.Remove(key); ok {
+		return val, true
+	}
+	s.ghost.Remove(key)
+	return value{}, false
+}
+
+func (s *twoQueueStore) RemoveOldest() (string, value, bool) {
+	return s.evict(false)
+}
+
+func (s *twoQueueStore) Keys() []string {
+	return append(s.frequent.Keys(), s.recent.Keys()...)
+}
+
+func (s *twoQueueStore) Len() int {
+	return s.recent.Len() + s.frequent.Len()
+}
@@ -0,0 +1,127 @@
+package bcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+)
+
+// Codec defines interface to encode and decode the value
+// stored by Typed.
+//
+// Protobuf could be used by implementing this interface
+// using proto.Marshal and proto.Unmarshal.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is Codec which encode the value as JSON
+type JSONCodec struct{}
+
+// Marshal implements Codec.Marshal
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return marshal(v)
+}
+
+// Unmarshal implements Codec.Unmarshal
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return unmarshal(data, v)
+}
+
+// GobCodec is Codec which encode the value using encoding/gob
+type GobCodec struct{}
+
+// Marshal implements Codec.Marshal
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec.Unmarshal
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Typed is typed wrapper of Bcache.
+// The values are encoded using the given Codec
+// and stored as byte slice in the underlying Bcache.
+type Typed[T any] struct {
+	bc    *Bcache
+	codec Codec
+}
+
+// NewTyped creates new Typed from the given Bcache and Codec.
+// If codec is nil, JSONCodec will be used.
+func NewTyped[T any](bc *Bcache, codec Codec) *Typed[T] {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &Typed[T]{
+		bc:    bc,
+		codec: codec,
+	}
+}
+
+// Set sets value for the given key with the given ttl in second.
+// if ttl <= 0, the key will expired instantly
+func (t *Typed[T]) Set(key string, val T, ttl int) error {
+	b, err := t.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	t.bc.SetBytes(key, b, ttl)
+	return nil
+}
+
+// Get gets value for the given key.
+//
+// It returns the value and true if the key exists.
+// Error returned if the value failed to be decoded.
+func (t *Typed[T]) Get(key string) (T, bool, error) {
+	var val T
+
+	b, ok := t.bc.GetBytes(key)
+	if !ok {
+		return val, false, nil
+	}
+
+	if err := t.codec.Unmarshal(b, &val); err != nil {
+		return val, false, err
+	}
+	return val, true, nil
+}
+
+// Delete the given key.
+func (t *Typed[T]) Delete(key string) {
+	t.bc.Delete(key)
+}
+
+// GetWithFiller gets value for the given key and fill the cache
+// if the given key is not exists.
+//
+// See Bcache.GetWithFiller for the details.
+func (t *Typed[T]) GetWithFiller(key string, filler func(key string) (T, error), ttl int) (T, error) {
+	var val T
+
+	if filler == nil {
+		return val, ErrNilFiller
+	}
+
+	b, err := t.bc.getWithFiller(context.Background(), key, func(ctx context.Context, key string) ([]byte, error) {
+		val, err := filler(key)
+		if err != nil {
+			return nil, err
+		}
+		return t.codec.Marshal(val)
+	}, ttl)
+	if err != nil {
+		return val, err
+	}
+
+	err = t.codec.Unmarshal(b, &val)
+	return val, err
+}
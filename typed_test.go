@@ -0,0 +1,84 @@
+package bcache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type typedTestVal struct {
+	Name  string
+	Count int
+}
+
+func TestTyped(t *testing.T) {
+	testCases := []struct {
+		name  string
+		codec Codec
+	}{
+		{
+			name:  "default codec",
+			codec: nil,
+		},
+		{
+			name:  "json",
+			codec: JSONCodec{},
+		},
+		{
+			name:  "gob",
+			codec: GobCodec{},
+		},
+	}
+
+	var (
+		val = typedTestVal{Name: "name", Count: 10}
+		ttl = 60
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			typed := NewTyped[typedTestVal](newLocalBcache(t), tc.codec)
+
+			_, ok, err := typed.Get("key")
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			err = typed.Set("key", val, ttl)
+			require.NoError(t, err)
+
+			got, ok, err := typed.Get("key")
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, val, got)
+		})
+	}
+}
+
+func TestTypedGetWithFiller(t *testing.T) {
+	var (
+		errFillerFailed = errors.New("filler failed")
+		ttl             = 60
+		typed           = NewTyped[typedTestVal](newLocalBcache(t), GobCodec{})
+	)
+
+	_, err := typed.GetWithFiller("nil", nil, ttl)
+	require.Equal(t, ErrNilFiller, err)
+
+	_, err = typed.GetWithFiller("failed", func(key string) (typedTestVal, error) {
+		return typedTestVal{}, errFillerFailed
+	}, ttl)
+	require.Equal(t, errFillerFailed, err)
+
+	got, err := typed.GetWithFiller("valid", func(key string) (typedTestVal, error) {
+		return typedTestVal{Name: key}, nil
+	}, ttl)
+	require.NoError(t, err)
+	require.Equal(t, typedTestVal{Name: "valid"}, got)
+
+	// the value must be in the cache now
+	got, ok, err := typed.Get("valid")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, typedTestVal{Name: "valid"}, got)
+}
@@ -0,0 +1,189 @@
+package bcache
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultWatchBufferSize = 256
+)
+
+// EventType is type of the change of a key
+type EventType int
+
+const (
+	// EventSet is emitted when the value of a key is set
+	EventSet EventType = iota + 1
+
+	// EventDelete is emitted when a key is deleted
+	EventDelete
+
+	// EventExpire is emitted when an expired key is removed from the cache
+	EventExpire
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// Event is a change of a key, streamed by Watch
+type Event struct {
+	Type EventType
+	Key  string
+
+	// Value is the new value of EventSet, and the removed value of EventExpire.
+	// It is shared with the cache, and must not be modified.
+	Value []byte
+
+	// Origin is the PeerID of the peer which made the change,
+	// EventExpire always comes from this peer.
+	Origin uint64
+
+	// Dropped is number of the events dropped before this one,
+	// because the subscriber was too slow.
+	// The subscriber could re-read the keys it is interested in to resync.
+	Dropped int
+}
+
+// watcher is a subscriber of the events of the keys with the given prefix
+type watcher struct {
+	prefix string
+
+	mux     sync.Mutex // protects the fields below
+	ch      chan Event
+	dropped int
+	closed  bool
+}
+
+// send sends the event without blocking, the event is dropped if the buffer is full
+func (w *watcher) send(ev Event) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	ev.Dropped = w.dropped
+	select {
+	case w.ch <- ev:
+		w.dropped = 0
+	default:
+		w.dropped++
+	}
+}
+
+func (w *watcher) close() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+}
+
+// watchHub dispatches the events to the watchers
+type watchHub struct {
+	bufSize int
+
+	numWatchers int32 // to skip the lock when nobody watch
+	mux         sync.RWMutex
+	watchers    map[*watcher]struct{}
+	closed      bool
+	doneCh      chan struct{} // closed when the hub is closed
+}
+
+func newWatchHub(bufSize int) *watchHub {
+	if bufSize <= 0 {
+		bufSize = defaultWatchBufferSize
+	}
+	return &watchHub{
+		bufSize:  bufSize,
+		watchers: make(map[*watcher]struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// watch registers new watcher of the given prefix until the context is done.
+// The returned channel is already closed if the hub has been closed.
+func (h *watchHub) watch(ctx context.Context, prefix string) <-chan Event {
+	w := &watcher{
+		prefix: prefix,
+		ch:     make(chan Event, h.bufSize),
+	}
+
+	h.mux.Lock()
+	if h.closed {
+		h.mux.Unlock()
+		w.close()
+		return w.ch
+	}
+	h.watchers[w] = struct{}{}
+	atomic.StoreInt32(&h.numWatchers, int32(len(h.watchers)))
+	h.mux.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.unwatch(w)
+		case <-h.doneCh:
+			// already closed by the hub
+		}
+	}()
+
+	return w.ch
+}
+
+func (h *watchHub) unwatch(w *watcher) {
+	h.mux.Lock()
+	delete(h.watchers, w)
+	atomic.StoreInt32(&h.numWatchers, int32(len(h.watchers)))
+	h.mux.Unlock()
+
+	w.close()
+}
+
+// publish sends the event to the watchers of the key
+func (h *watchHub) publish(ev Event) {
+	if atomic.LoadInt32(&h.numWatchers) == 0 {
+		return
+	}
+
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+
+	for w := range h.watchers {
+		if strings.HasPrefix(ev.Key, w.prefix) {
+			w.send(ev)
+		}
+	}
+}
+
+// close closes all of the watchers
+func (h *watchHub) close() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.doneCh)
+	for w := range h.watchers {
+		w.close()
+		delete(h.watchers, w)
+	}
+	atomic.StoreInt32(&h.numWatchers, 0)
+}
@@ -0,0 +1,140 @@
+package bcache
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestWatchHub(t *testing.T) {
+	hub := newWatchHub(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	all := hub.watch(ctx, "")
+	prefixed := hub.watch(ctx, "config/")
+
+	hub.publish(Event{Type: EventSet, Key: "config/a"})
+	hub.publish(Event{Type: EventSet, Key: "other"})
+
+	require.Equal(t, Event{Type: EventSet, Key: "config/a"}, <-all)
+	require.Equal(t, Event{Type: EventSet, Key: "other"}, <-all)
+	require.Equal(t, Event{Type: EventSet, Key: "config/a"}, <-prefixed)
+
+	// slow watcher
+	for i := 0; i < 5; i++ {
+		hub.publish(Event{Type: EventSet, Key: fmt.Sprintf("config/%d", i)})
+	}
+	require.Equal(t, "config/0", (<-prefixed).Key)
+	require.Equal(t, "config/1", (<-prefixed).Key)
+
+	hub.publish(Event{Type: EventDelete, Key: "config/5"})
+	require.Equal(t, Event{Type: EventDelete, Key: "config/5", Dropped: 3}, <-prefixed)
+
+	// closed once the context is done
+	cancel()
+	require.Eventually(t, func() bool {
+		hub.mux.RLock()
+		defer hub.mux.RUnlock()
+		return len(hub.watchers) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	for range all {
+	}
+	for range prefixed {
+	}
+	hub.publish(Event{Type: EventSet, Key: "config/a"})
+}
+
+func TestWatchHubClose(t *testing.T) {
+	hub := newWatchHub(0)
+	numGoroutines := runtime.NumGoroutine()
+
+	ch := hub.watch(context.Background(), "")
+	hub.close()
+	hub.close()
+
+	// the watcher goroutine is released
+	for i := 0; i < 100 && runtime.NumGoroutine() > numGoroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), numGoroutines)
+
+	_, ok := <-ch
+	require.False(t, ok)
+
+	// watch after closed
+	_, ok = <-hub.watch(context.Background(), "")
+	require.False(t, ok)
+}
+
+func TestWatchLocal(t *testing.T) {
+	bc := newLocalBcache(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := bc.Watch(ctx, "key")
+
+	bc.Set("key1", "val1", 60)
+	bc.Set("other", "val", 60)
+	bc.SetMulti(map[string]string{"key2": "val2"}, 60)
+	bc.Delete("key1")
+	bc.peer.cc.Set("key3", entry{Val: []byte("val3"), Expired: time.Now().UnixNano()})
+	_, ok := bc.Get("key3")
+	require.False(t, ok)
+
+	origin := uint64(bc.peer.name)
+	require.Equal(t, Event{Type: EventSet, Key: "key1", Value: []byte("val1"), Origin: origin}, <-ch)
+	require.Equal(t, Event{Type: EventSet, Key: "key2", Value: []byte("val2"), Origin: origin}, <-ch)
+	require.Equal(t, Event{Type: EventDelete, Key: "key1", Origin: origin}, <-ch)
+	require.Equal(t, Event{Type: EventExpire, Key: "key3", Value: []byte("val3"), Origin: origin}, <-ch)
+}
+
+func TestWatchRemote(t *testing.T) {
+	expired := time.Now().Add(time.Hour).UnixNano()
+
+	p, err := newPeer(mesh.PeerName(1), Config{MaxKeys: 1000, Logger: &nopLogger{}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := p.cc.watch.watch(ctx, "")
+
+	msg := newMessageFromEntries(mesh.PeerName(2), map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: expired,
+			Version: version{Clock: 1, Origin: 3},
+		},
+	})
+	_, err = p.OnGossipBroadcast(mesh.PeerName(2), msg.Encode()[0])
+	require.NoError(t, err)
+	require.Equal(t, Event{Type: EventSet, Key: "key1", Value: []byte("val1"), Origin: 3}, <-ch)
+
+	// metadata only change is not an event
+	msg.Entries = map[string]entry{
+		"key1": {
+			Expired:  expired + 1,
+			Version:  version{Clock: 2, Origin: 3},
+			MetaOnly: true,
+			Base:     version{Clock: 1, Origin: 3},
+		},
+	}
+	_, err = p.OnGossip(msg.Encode()[0])
+	require.NoError(t, err)
+
+	msg.Entries = map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: expired + 1,
+			Deleted: time.Now().UnixNano(),
+			Version: version{Clock: 3, Origin: 2},
+		},
+	}
+	require.NoError(t, p.OnGossipUnicast(mesh.PeerName(2), msg.Encode()[0]))
+	require.Equal(t, Event{Type: EventDelete, Key: "key1", Origin: 2}, <-ch)
+}
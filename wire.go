@@ -0,0 +1,436 @@
+package bcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/weaveworks/mesh"
+)
+
+// bcache binary gossip format
+//
+//	format version             : 1 byte
+//	peer ID                    : uvarint
+//	number of entries          : uvarint
+//	entries, for each entry :
+//		key length     : uvarint
+//		key            : bytes
+//		value length   : uvarint
+//		value          : bytes
+//		expired        : varint
+//		deleted        : varint
+//		version clock  : uvarint
+//		version origin : uvarint
+//		flags          : uvarint
+//		base           : uvarint clock and uvarint origin, only for metadata only entry
+//	number of digest buckets   : uvarint
+//	bucket hash                : 8 bytes little endian, for each bucket
+//	number of repair buckets   : uvarint
+//	repair bucket index        : uvarint, for each repair bucket
+//	ack request ID             : uvarint, 0 if no acknowledgement requested
+//	number of acks             : uvarint
+//	acked request ID           : uvarint, for each ack
+//	number of range tombstones : uvarint
+//	range tombstones, for each range tombstone :
+//		prefix length  : uvarint
+//		prefix         : bytes
+//		deleted        : varint
+//		version clock  : uvarint
+//		version origin : uvarint
+//
+// The old JSON format always starts with '{', which is never
+// a valid format version, so both formats could be detected from the first byte.
+const (
+	wireFormatV1 byte = 1
+
+	// wireFormatVersion is the format version used by the encoder
+	wireFormatVersion = wireFormatV1
+
+	defaultChunkKeys  = 1000
+	defaultChunkBytes = 1024 * 1024 // 1 MB
+
+	// estimated encoding overhead of a single entry
+	entryOverhead = 9 * binary.MaxVarintLen64
+)
+
+// entry flags
+const (
+	entryFlagMetaOnly uint64 = 1 << iota
+)
+
+var (
+	errEmptyMessage     = errors.New("empty gossip message")
+	errTruncatedMessage = errors.New("truncated gossip message")
+)
+
+// wireOptions defines how a message is encoded
+type wireOptions struct {
+	// encode using the old JSON format
+	legacyJSON bool
+
+	// max number of keys and max size in bytes of an encoded chunk.
+	// zero means using the default value
+	chunkKeys  int
+	chunkBytes int
+}
+
+// chunks splits the entries, so that every chunk could be encoded
+// and merged on its own.
+// A single entry which exceeds the byte limit will be put in it's own chunk.
+func (o wireOptions) chunks(entries map[string]entry) []map[string]entry {
+	maxKeys, maxBytes := o.chunkKeys, o.chunkBytes
+	if maxKeys <= 0 {
+		maxKeys = defaultChunkKeys
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultChunkBytes
+	}
+
+	if len(entries) <= maxKeys && entriesSize(entries) <= maxBytes {
+		return []map[string]entry{entries}
+	}
+
+	var (
+		chunks []map[string]entry
+		chunk  = make(map[string]entry)
+		size   int
+	)
+	for k, v := range entries {
+		entSize := entrySize(k, v)
+		if len(chunk) > 0 && (len(chunk) >= maxKeys || size+entSize > maxBytes) {
+			chunks = append(chunks, chunk)
+			chunk, size = make(map[string]entry), 0
+		}
+		chunk[k] = v
+		size += entSize
+	}
+	return append(chunks, chunk)
+}
+
+// entriesSize returns estimated encoded size of the entries
+func entriesSize(entries map[string]entry) int {
+	var size int
+	for k, v := range entries {
+		size += entrySize(k, v)
+	}
+	return size
+}
+
+func entrySize(key string, e entry) int {
+	return len(key) + len(e.Val) + entryOverhead
+}
+
+// jsonMessage is the JSON encoded form of message, used by the older peers.
+// The value is encoded as string to keep the encoding
+// compatible with the peers which store the value as string
+type jsonMessage struct {
+	PeerID  mesh.PeerName
+	Entries map[string]jsonEntry
+}
+
+type jsonEntry struct {
+	Val     string
+	Expired int64
+	Deleted int64
+
+	// Version is ignored by the older peers
+	Version *version `json:",omitempty"`
+}
+
+// decodeMessage decodes the message from both the binary and JSON format
+func decodeMessage(b []byte) (*message, error) {
+	if len(b) == 0 {
+		return nil, errEmptyMessage
+	}
+	if isJSONMessage(b) {
+		return decodeJSON(b)
+	}
+	return decodeBinary(b)
+}
+
+func isJSONMessage(b []byte) bool {
+	for _, c := range b {
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// encodeJSON encodes the message using the old JSON format,
+// the anti entropy, acknowledgement data and range tombstones are not supported by this format.
+func encodeJSON(m *message) ([]byte, error) {
+	jm := jsonMessage{
+		PeerID:  m.PeerID,
+		Entries: make(map[string]jsonEntry, len(m.Entries)),
+	}
+	for k, v := range m.Entries {
+		je := jsonEntry{
+			Val:     string(v.Val),
+			Expired: v.Expired,
+			Deleted: v.Deleted,
+		}
+		if !v.Version.isZero() {
+			ver := v.Version
+			je.Version = &ver
+		}
+		jm.Entries[k] = je
+	}
+	return marshal(jm)
+}
+
+func decodeJSON(b []byte) (*message, error) {
+	var jm jsonMessage
+	if err := unmarshal(b, &jm); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]entry, len(jm.Entries))
+	for k, v := range jm.Entries {
+		var val []byte
+		if v.Val != "" {
+			val = []byte(v.Val)
+		}
+		e := entry{
+			Val:     val,
+			Expired: v.Expired,
+			Deleted: v.Deleted,
+		}
+		if v.Version != nil {
+			e.Version = *v.Version
+		}
+		entries[k] = e
+	}
+	return &message{
+		PeerID:  jm.PeerID,
+		Entries: entries,
+	}, nil
+}
+
+func encodeBinary(m *message) []byte {
+	size := 1 + 6*binary.MaxVarintLen64 + entriesSize(m.Entries) +
+		8*len(m.Digest) + binary.MaxVarintLen32*len(m.Repair) + binary.MaxVarintLen64*len(m.Acks) +
+		rangesSize(m.Ranges)
+
+	b := make([]byte, 0, size)
+	b = append(b, wireFormatVersion)
+	b = binary.AppendUvarint(b, uint64(m.PeerID))
+	b = binary.AppendUvarint(b, uint64(len(m.Entries)))
+	for k, v := range m.Entries {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = binary.AppendUvarint(b, uint64(len(v.Val)))
+		b = append(b, v.Val...)
+		b = binary.AppendVarint(b, v.Expired)
+		b = binary.AppendVarint(b, v.Deleted)
+		b = binary.AppendUvarint(b, v.Version.Clock)
+		b = binary.AppendUvarint(b, uint64(v.Version.Origin))
+		b = binary.AppendUvarint(b, v.flags())
+		if v.MetaOnly {
+			b = binary.AppendUvarint(b, v.Base.Clock)
+			b = binary.AppendUvarint(b, uint64(v.Base.Origin))
+		}
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(m.Digest)))
+	for _, h := range m.Digest {
+		b = binary.LittleEndian.AppendUint64(b, h)
+	}
+	b = binary.AppendUvarint(b, uint64(len(m.Repair)))
+	for _, bucket := range m.Repair {
+		b = binary.AppendUvarint(b, uint64(bucket))
+	}
+
+	b = binary.AppendUvarint(b, m.AckID)
+	b = binary.AppendUvarint(b, uint64(len(m.Acks)))
+	for _, id := range m.Acks {
+		b = binary.AppendUvarint(b, id)
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(m.Ranges)))
+	for _, r := range m.Ranges {
+		b = binary.AppendUvarint(b, uint64(len(r.Prefix)))
+		b = append(b, r.Prefix...)
+		b = binary.AppendVarint(b, r.Deleted)
+		b = binary.AppendUvarint(b, r.Version.Clock)
+		b = binary.AppendUvarint(b, uint64(r.Version.Origin))
+	}
+	return b
+}
+
+// rangesSize returns estimated encoded size of the range tombstones
+func rangesSize(ranges []rangeTombstone) int {
+	var size int
+	for _, r := range ranges {
+		size += len(r.Prefix) + 4*binary.MaxVarintLen64
+	}
+	return size
+}
+
+func decodeBinary(b []byte) (*message, error) {
+	if b[0] != wireFormatV1 {
+		return nil, fmt.Errorf("unsupported gossip format version: %d", b[0])
+	}
+	d := wireDecoder{buf: b[1:]}
+
+	peerID := d.uvarint()
+	numEntries := d.uvarint()
+	if d.err != nil {
+		return nil, d.err
+	}
+	// every entry needs at least 4 bytes, don't trust the given number blindly
+	if numEntries > uint64(len(d.buf)/4) {
+		return nil, errTruncatedMessage
+	}
+
+	entries := make(map[string]entry, numEntries)
+	for i := uint64(0); i < numEntries; i++ {
+		key := d.bytes()
+		val := d.bytes()
+		var e entry
+		e.Expired = d.varint()
+		e.Deleted = d.varint()
+		e.Version.Clock = d.uvarint()
+		e.Version.Origin = mesh.PeerName(d.uvarint())
+		e.setFlags(d.uvarint())
+		if e.MetaOnly {
+			e.Base.Clock = d.uvarint()
+			e.Base.Origin = mesh.PeerName(d.uvarint())
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+		if len(val) > 0 {
+			// copy the value, so the cached value doesn't keep
+			// the whole received buffer in memory
+			e.Val = append([]byte(nil), val...)
+		}
+		entries[string(key)] = e
+	}
+
+	m := &message{
+		PeerID:  mesh.PeerName(peerID),
+		Entries: entries,
+	}
+
+	numDigest := d.uvarint()
+	if d.err == nil && numDigest > uint64(len(d.buf)/8) {
+		return nil, errTruncatedMessage
+	}
+	for i := uint64(0); i < numDigest; i++ {
+		m.Digest = append(m.Digest, d.uint64())
+	}
+	numRepair := d.uvarint()
+	if d.err == nil && numRepair > uint64(len(d.buf)) {
+		return nil, errTruncatedMessage
+	}
+	for i := uint64(0); i < numRepair; i++ {
+		m.Repair = append(m.Repair, uint32(d.uvarint()))
+	}
+
+	m.AckID = d.uvarint()
+	numAcks := d.uvarint()
+	if d.err == nil && numAcks > uint64(len(d.buf)) {
+		return nil, errTruncatedMessage
+	}
+	for i := uint64(0); i < numAcks; i++ {
+		m.Acks = append(m.Acks, d.uvarint())
+	}
+
+	numRanges := d.uvarint()
+	// every range tombstone needs at least 4 bytes
+	if d.err == nil && numRanges > uint64(len(d.buf)/4) {
+		return nil, errTruncatedMessage
+	}
+	for i := uint64(0); i < numRanges; i++ {
+		var r rangeTombstone
+		r.Prefix = string(d.bytes())
+		r.Deleted = d.varint()
+		r.Version.Clock = d.uvarint()
+		r.Version.Origin = mesh.PeerName(d.uvarint())
+		m.Ranges = append(m.Ranges, r)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return m, nil
+}
+
+func (e *entry) flags() uint64 {
+	var flags uint64
+	if e.MetaOnly {
+		flags |= entryFlagMetaOnly
+	}
+	return flags
+}
+
+func (e *entry) setFlags(flags uint64) {
+	e.MetaOnly = flags&entryFlagMetaOnly != 0
+}
+
+// wireDecoder reads the binary format.
+// It records the first error and stops reading afterwards
+type wireDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *wireDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errTruncatedMessage
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *wireDecoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 8 {
+		d.err = errTruncatedMessage
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v
+}
+
+func (d *wireDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errTruncatedMessage
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// bytes reads length prefixed bytes
+func (d *wireDecoder) bytes() []byte {
+	l := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if l > uint64(len(d.buf)) {
+		d.err = errTruncatedMessage
+		return nil
+	}
+	b := d.buf[:l:l]
+	d.buf = d.buf[l:]
+	return b
+}
@@ -0,0 +1,331 @@
+package bcache
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestWireEncodeDecode(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    wireOptions
+		entries map[string]entry
+	}{
+		{
+			name:    "binary empty",
+			entries: map[string]entry{},
+		},
+		{
+			name: "binary",
+			entries: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 1,
+				},
+				"key2": {
+					Val:     []byte{0, 1, 2, 255},
+					Expired: 2,
+					Deleted: 1,
+					Version: version{Clock: 1 << 60, Origin: 12345678},
+				},
+				"key3": {
+					Expired: -1,
+					Deleted: 3,
+				},
+				"key4": {
+					Expired:  20,
+					Version:  version{Clock: 5, Origin: 1},
+					MetaOnly: true,
+					Base:     version{Clock: 4, Origin: 2},
+				},
+			},
+		},
+		{
+			name: "legacy json",
+			opts: wireOptions{legacyJSON: true},
+			entries: map[string]entry{
+				"key1": {
+					Val:     []byte("val1"),
+					Expired: 1,
+					Version: version{Clock: 10, Origin: 2},
+				},
+				"key2": {
+					Expired: 2,
+					Deleted: 1,
+				},
+			},
+		},
+	}
+
+	peerID := mesh.PeerName(12345678)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := newMessageFromEntries(peerID, tc.entries)
+			msg.opts = tc.opts
+
+			bufs := msg.Encode()
+			require.Len(t, bufs, 1)
+			require.Equal(t, tc.opts.legacyJSON, isJSONMessage(bufs[0]))
+
+			decoded, err := newMessageFromBuf(bufs[0])
+			require.NoError(t, err)
+			require.Equal(t, peerID, decoded.PeerID)
+			require.Equal(t, tc.entries, decoded.Entries)
+		})
+	}
+}
+
+// message encoded by the older peers
+func TestWireDecodeLegacyJSON(t *testing.T) {
+	buf := []byte(`{"PeerID":2,"Entries":{"key1":{"Val":"val1","Expired":10,"Deleted":0},"key2":{"Val":"","Expired":20,"Deleted":5}}}`)
+
+	msg, err := newMessageFromBuf(buf)
+	require.NoError(t, err)
+	require.Equal(t, mesh.PeerName(2), msg.PeerID)
+	require.Equal(t, map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: 10,
+		},
+		"key2": {
+			Expired: 20,
+			Deleted: 5,
+		},
+	}, msg.Entries)
+}
+
+func TestWireDecodeInvalid(t *testing.T) {
+	valid := encodeBinary(newMessageFromEntries(1, map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: 1,
+		},
+	}))
+
+	testCases := []struct {
+		name string
+		buf  []byte
+	}{
+		{
+			name: "empty",
+			buf:  nil,
+		},
+		{
+			name: "unknown version",
+			buf:  []byte{99, 1, 0},
+		},
+		{
+			name: "truncated",
+			buf:  valid[:len(valid)-3],
+		},
+		{
+			name: "too many entries",
+			buf:  []byte{wireFormatV1, 1, 100, 0},
+		},
+		{
+			name: "invalid json",
+			buf:  []byte(`{"PeerID":`),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newMessageFromBuf(tc.buf)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestWireChunks(t *testing.T) {
+	const numKeys = 2500
+
+	entries := make(map[string]entry, numKeys)
+	for i := 0; i < numKeys; i++ {
+		entries[fmt.Sprintf("key-%d", i)] = entry{
+			Val:     bytes.Repeat([]byte("v"), 100),
+			Expired: int64(i),
+		}
+	}
+
+	testCases := []struct {
+		name      string
+		opts      wireOptions
+		numChunks int
+	}{
+		{
+			name:      "default",
+			numChunks: 3,
+		},
+		{
+			name:      "by keys",
+			opts:      wireOptions{chunkKeys: 500},
+			numChunks: 5,
+		},
+		{
+			name: "by bytes",
+			opts: wireOptions{chunkKeys: numKeys, chunkBytes: 50 * 1024},
+		},
+		{
+			name:      "legacy json",
+			opts:      wireOptions{legacyJSON: true, chunkKeys: 1000},
+			numChunks: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := newMessageFromEntries(mesh.PeerName(1), entries)
+			msg.opts = tc.opts
+
+			bufs := msg.Encode()
+			if tc.numChunks > 0 {
+				require.Len(t, bufs, tc.numChunks)
+			} else {
+				// exact number depends on the entry encoding overhead
+				require.True(t, len(bufs) > 1)
+			}
+
+			// every chunk is a message on its own
+			got := make(map[string]entry)
+			for _, buf := range bufs {
+				if tc.opts.chunkBytes > 0 {
+					require.True(t, len(buf) <= tc.opts.chunkBytes)
+				}
+				chunk, err := newMessageFromBuf(buf)
+				require.NoError(t, err)
+				for k, v := range chunk.Entries {
+					got[k] = v
+				}
+			}
+			require.Equal(t, entries, got)
+		})
+	}
+}
+
+func TestWireChunksBigEntry(t *testing.T) {
+	opts := wireOptions{chunkBytes: 1024}
+	entries := map[string]entry{
+		"small": {Val: []byte("val")},
+		"big":   {Val: bytes.Repeat([]byte("v"), 2048)},
+	}
+
+	chunks := opts.chunks(entries)
+	require.Len(t, chunks, 2)
+	for _, chunk := range chunks {
+		require.Len(t, chunk, 1)
+	}
+}
+
+func TestWireAntiEntropy(t *testing.T) {
+	msg := newMessageFromEntries(mesh.PeerName(1), map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: 1,
+		},
+	})
+	msg.Digest = []uint64{0, 1, 1 << 63}
+	msg.Repair = []uint32{2, 300}
+
+	bufs := msg.Encode()
+	require.Len(t, bufs, 1)
+
+	decoded, err := newMessageFromBuf(bufs[0])
+	require.NoError(t, err)
+	require.Equal(t, msg.Entries, decoded.Entries)
+	require.Equal(t, msg.Digest, decoded.Digest)
+	require.Equal(t, msg.Repair, decoded.Repair)
+
+	// anti entropy data only sent in the first chunk
+	msg.opts.chunkKeys = 1
+	msg.Entries["key2"] = entry{Val: []byte("val2")}
+
+	bufs = msg.Encode()
+	require.Len(t, bufs, 2)
+
+	second, err := newMessageFromBuf(bufs[1])
+	require.NoError(t, err)
+	require.Nil(t, second.Digest)
+	require.Nil(t, second.Repair)
+}
+
+func TestWireAcks(t *testing.T) {
+	msg := newMessageFromEntries(mesh.PeerName(1), map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: 1,
+		},
+	})
+	msg.AckID = 1 << 40
+	msg.Acks = []uint64{1, 300}
+
+	bufs := msg.Encode()
+	require.Len(t, bufs, 1)
+
+	decoded, err := newMessageFromBuf(bufs[0])
+	require.NoError(t, err)
+	require.Equal(t, msg.Entries, decoded.Entries)
+	require.Equal(t, msg.AckID, decoded.AckID)
+	require.Equal(t, msg.Acks, decoded.Acks)
+
+	// truncated acks, the last byte is the number of range tombstones
+	buf := bufs[0]
+	_, err = newMessageFromBuf(buf[:len(buf)-2])
+	require.Equal(t, errTruncatedMessage, err)
+}
+
+func TestWireRanges(t *testing.T) {
+	msg := newMessageFromEntries(mesh.PeerName(1), map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: 1,
+		},
+	})
+	msg.Ranges = []rangeTombstone{
+		{Prefix: "tenant-1/", Deleted: 10, Version: version{Clock: 1 << 40, Origin: 1}},
+		{Prefix: "", Deleted: 20, Version: version{Clock: 2, Origin: 300}},
+	}
+
+	bufs := msg.Encode()
+	require.Len(t, bufs, 1)
+
+	decoded, err := newMessageFromBuf(bufs[0])
+	require.NoError(t, err)
+	require.Equal(t, msg.Entries, decoded.Entries)
+	require.Equal(t, msg.Ranges, decoded.Ranges)
+
+	// truncated range tombstones
+	msg.Ranges = []rangeTombstone{{Prefix: "tenant-1/", Deleted: 10, Version: version{Clock: 1, Origin: 1}}}
+	buf := msg.Encode()[0]
+	_, err = newMessageFromBuf(buf[:len(buf)-1])
+	require.Equal(t, errTruncatedMessage, err)
+}
+
+// message encoded following the documented format
+func TestWireDecodeV1(t *testing.T) {
+	buf := []byte{
+		wireFormatV1, 2, 1,
+		// entry: key, value, expired, deleted, version, flags
+		4, 'k', 'e', 'y', '1', 4, 'v', 'a', 'l', '1', 20, 0, 0, 0, 0,
+		// digest, repair, acks, range tombstones
+		0, 0, 0, 0, 0,
+	}
+
+	msg, err := newMessageFromBuf(buf)
+	require.NoError(t, err)
+	require.Equal(t, mesh.PeerName(2), msg.PeerID)
+	require.Equal(t, map[string]entry{
+		"key1": {
+			Val:     []byte("val1"),
+			Expired: 10,
+		},
+	}, msg.Entries)
+
+	// the value doesn't share the received buffer
+	buf[9] = 'X'
+	require.Equal(t, []byte("val1"), msg.Entries["key1"].Val)
+}